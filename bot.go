@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Bot holds everything belonging to one upstream bot, so that multiple bots can be served by one Server.
+type Bot struct {
+	conf     *ConfigBot
+	db       *Database
+	c        *Client
+	webhooks *WebhookDispatcher
+	pruner   *Pruner
+	outbox   *Outbox
+	schedule *Scheduler
+}
+
+func NewBot(conf *ConfigBot, conn *sql.DB) (*Bot, error) {
+	db, err := NewDatabase(conn, *conf.DBNamespace)
+	if err != nil {
+		return nil, err
+	}
+	c := NewClient(conf, db)
+	outbox := NewOutbox(conf, db, c)
+	b := &Bot{
+		conf:     conf,
+		db:       db,
+		c:        c,
+		webhooks: NewWebhookDispatcher(conf, db),
+		pruner:   NewPruner(conf, db),
+		outbox:   outbox,
+		schedule: NewScheduler(db, outbox),
+	}
+	err = b.webhooks.Start(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to start webhook delivery: %v", err)
+	}
+	err = b.outbox.Start(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to start outbox: %v", err)
+	}
+	b.schedule.Start(context.Background())
+	b.pruner.Start(context.Background())
+	return b, nil
+}
@@ -3,14 +3,21 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"runtime/debug"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,17 +25,23 @@ import (
 )
 
 type Client struct {
-	conf                *Config
+	conf                *ConfigBot
 	db                  *Database
 	updateTypeIsMessage map[string]struct{}
 	echoUpdateType      map[string]string
 	nextRetryInterval   time.Duration
-	globalCooldown      *CooldownQueue
-	chatCooldown        map[int64]*CooldownQueue
-	chatCooldownMtx     sync.Mutex
+	filterUpdateTypes   string
+	cooldown            *CooldownScheduler
+	mtx                 sync.Mutex
+	botUser             string
+	// Lookups which failed recently, with the time they can be retried
+	queryFailures map[string]time.Time
 }
 
-func NewClient(conf *Config, db *Database) *Client {
+// A failed lookup through queryUpstream is not retried for this duration
+const queryFailureTTL = 5 * time.Minute
+
+func NewClient(conf *ConfigBot, db *Database) *Client {
 	c := &Client{
 		conf: conf,
 		db:   db,
@@ -41,16 +54,15 @@ func NewClient(conf *Config, db *Database) *Client {
 			"edited_business_message": {},
 		},
 		nextRetryInterval: time.Second,
-		globalCooldown:    NewCooldownQueue(),
-		chatCooldown:      make(map[int64]*CooldownQueue),
-		chatCooldownMtx:   sync.Mutex{},
+		queryFailures:     make(map[string]time.Time),
+		cooldown:          NewCooldownScheduler(conf.RateLimit.Global, time.Duration(conf.RateLimit.StarvationTimeout)*time.Second),
 	}
 	c.echoUpdateType = map[string]string{
 		"sendMessage":             "message",
 		"forwardMessage":          "message",
-		"forwardMessages":         "", // We don't generate local echo update, but we rate-limit outgoing requests.
-		"copyMessage":             "",
-		"copyMessages":            "",
+		"forwardMessages":         "message", // The upstream only returns the message IDs, see processEchoCopy
+		"copyMessage":             "message",
+		"copyMessages":            "message",
 		"sendPhoto":               "message",
 		"sendAudio":               "message",
 		"sendDocument":            "message",
@@ -75,13 +87,21 @@ func NewClient(conf *Config, db *Database) *Client {
 	return c
 }
 
-func (c *Client) StartPolling(ctx context.Context) error {
+// Start receives updates from the upstream, using the mode specified in the configuration file.
+func (c *Client) Start(ctx context.Context) error {
+	if c.conf.Upstream.Mode == "webhook" {
+		return c.StartWebhook(ctx)
+	}
+	return c.StartPolling(ctx)
+}
+
+// callUpstream calls an upstream API method, retrying until it succeeds or fails with a fatal error.
+func (c *Client) callUpstream(ctx context.Context, method, requestBody string) error {
 	for {
-		requestURL := c.conf.Upstream.ApiPrefix + "/deleteWebhook"
-		requestBody := bytes.NewBufferString("drop_pending_updates=false")
-		log.Printf("[ HTTP POST ] %s %s\n", requestURL, requestBody.String())
+		requestURL := c.conf.Upstream.ApiPrefix + "/" + method
+		log.Printf("[ HTTP POST ] %s %s\n", requestURL, requestBody)
 
-		req, err := http.NewRequestWithContext(ctx, "POST", requestURL, requestBody)
+		req, err := http.NewRequestWithContext(ctx, "POST", requestURL, bytes.NewBufferString(requestBody))
 		if err != nil {
 			debug.PrintStack()
 			return fmt.Errorf("failed to send HTTP request: %v", err)
@@ -111,10 +131,20 @@ func (c *Client) StartPolling(ctx context.Context) error {
 		}
 
 		c.resetRetry()
-		break
+		return nil
 	}
+}
 
-	offset := uint64(0)
+func (c *Client) StartPolling(ctx context.Context) error {
+	err := c.callUpstream(ctx, "deleteWebhook", "drop_pending_updates=false")
+	if err != nil {
+		return err
+	}
+
+	offset, err := c.db.GetUpstreamOffset(ctx)
+	if err != nil {
+		return err
+	}
 	for {
 		requestURL := c.conf.Upstream.ApiPrefix + "/getUpdates"
 		var requestBody bytes.Buffer
@@ -123,7 +153,7 @@ func (c *Client) StartPolling(ctx context.Context) error {
 		}
 		fmt.Fprintf(&requestBody,
 			"timeout=%d&allowed_updates=%s",
-			c.conf.Upstream.PollingTimeout, c.conf.Upstream.FilterUpdateTypesStr,
+			c.conf.Upstream.PollingTimeout, c.upstreamFilterUpdateTypes(ctx),
 		)
 		log.Printf("[ HTTP POST ] %s %s\n", requestURL, requestBody.String())
 
@@ -177,52 +207,198 @@ func (c *Client) StartPolling(ctx context.Context) error {
 			continue
 		}
 
-		tx, err := c.db.BeginTx()
+		nextOffset, err := c.storeUpdates(bodyJson.Get("result"))
 		if err != nil {
 			debug.PrintStack()
 			log.Println("Failed to store updates:", err)
 			c.sleepUntilRetry()
 			continue
 		}
-		bodyJson.Get("result").ForEach(func(_, update gjson.Result) bool {
-			upstreamID := update.Get("update_id").Uint()
-			offset = max(offset, upstreamID+1)
-			update.ForEach(func(updateType, updateValue gjson.Result) bool {
-				if updateType.Str == "update_id" {
-					// Skip
-					return true
-				}
-				err = tx.InsertUpdate(upstreamID, updateType.String(), updateValue.Raw)
+		if nextOffset != 0 {
+			offset = nextOffset
+		} else if offset != 0 {
+			// Nothing new, so the upstream has confirmed every update before offset, and we stop sending it.
+			// After a week without updates, the upstream picks the next update_id randomly, which may be lower than offset.
+			err = c.db.ClearUpstreamOffset(ctx)
+			if err != nil {
+				debug.PrintStack()
+				log.Println("Failed to clear upstream offset:", err)
+				c.sleepUntilRetry()
+				continue
+			}
+			offset = 0
+		}
+
+		c.resetRetry()
+	}
+}
+
+// StartWebhook registers our webhook to the upstream, and keeps its allowed_updates up to date.
+// Incoming updates are handled by HandleWebhook.
+func (c *Client) StartWebhook(ctx context.Context) error {
+	filterUpdateTypes := ""
+	for {
+		nextFilterUpdateTypes := c.upstreamFilterUpdateTypes(ctx)
+		if nextFilterUpdateTypes != filterUpdateTypes {
+			err := c.callUpstream(ctx, "setWebhook", fmt.Sprintf(
+				"url=%s&max_connections=%d&allowed_updates=%s&secret_token=%s",
+				url.QueryEscape(c.conf.Upstream.WebhookURL), c.conf.Upstream.WebhookMaxConnections, nextFilterUpdateTypes, url.QueryEscape(c.conf.Upstream.WebhookSecretToken),
+			))
+			if err != nil {
+				return err
+			}
+			filterUpdateTypes = nextFilterUpdateTypes
+		}
+
+		select {
+		case <-time.After(time.Duration(c.conf.Upstream.PollingTimeout) * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// HandleWebhook receives an update pushed by the upstream.
+func (c *Client) HandleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Telegram-Bot-Api-Secret-Token")), []byte(c.conf.Upstream.WebhookSecretToken)) != 1 {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, httpBodyLimit))
+	if err != nil {
+		log.Println("HTTP read error:", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	update := gjson.ParseBytes(body)
+	if !update.IsObject() {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Wrap the update into an array, so it shares the same code path as getUpdates
+	_, err = c.storeUpdates(gjson.Parse("[" + update.Raw + "]"))
+	if err != nil {
+		debug.PrintStack()
+		log.Println("Failed to store updates:", err)
+		// The upstream will retry later
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// storeUpdates inserts a list of upstream updates into the database, and returns the next upstream offset.
+func (c *Client) storeUpdates(updates gjson.Result) (uint64, error) {
+	tx, err := c.db.BeginTx()
+	if err != nil {
+		return 0, err
+	}
+	offset := uint64(0)
+	updates.ForEach(func(_, update gjson.Result) bool {
+		upstreamID := update.Get("update_id").Uint()
+		offset = max(offset, upstreamID+1)
+		update.ForEach(func(updateType, updateValue gjson.Result) bool {
+			if updateType.Str == "update_id" {
+				// Skip
+				return true
+			}
+			err = tx.InsertUpdate(upstreamID, updateType.String(), updateValue.Raw)
+			if err != nil {
+				return false
+			}
+			if _, ok := c.updateTypeIsMessage[updateType.Str]; ok {
+				err = tx.InsertMessage(&updateValue)
 				if err != nil {
 					return false
 				}
-				if _, ok := c.updateTypeIsMessage[updateType.Str]; ok {
-					err = tx.InsertMessage(&updateValue)
-					if err != nil {
-						return false
-					}
-				}
-				return true
-			})
-			return err == nil
+			}
+			return true
 		})
-		if err != nil {
-			tx.Commit()
-			debug.PrintStack()
-			log.Println("Failed to store updates:", err)
-			c.sleepUntilRetry()
-			continue
+		return err == nil
+	})
+	if err == nil && offset != 0 {
+		err = tx.SetUpstreamOffset(offset)
+	}
+	if err != nil {
+		tx.Commit()
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// upstreamFilterUpdateTypes returns the URL-escaped allowed_updates parameter for the next upstream getUpdates.
+// If auto_filter_update_types is enabled, it is the union of the configured types and the subscriptions of all clients.
+func (c *Client) upstreamFilterUpdateTypes(ctx context.Context) string {
+	if !c.conf.Upstream.AutoFilterUpdateTypes {
+		return c.conf.Upstream.FilterUpdateTypesStr
+	}
+
+	names := make([]string, len(c.conf.Downstream.Clients))
+	for i, client := range c.conf.Downstream.Clients {
+		names[i] = client.Name
+	}
+	// Subscriptions are stored in the database, so they survive restarts before clients reconnect.
+	subscriptions, err := c.db.GetConsumersAllowedUpdates(ctx, names)
+	if err != nil {
+		log.Println("Failed to retrieve client subscriptions:", err)
+		return c.conf.Upstream.FilterUpdateTypesStr
+	}
+	// Clients who have never polled will receive the default types once they connect
+	for range len(names) - len(subscriptions) {
+		subscriptions = append(subscriptions, nil)
+	}
+	// An empty filter_update_types means the default types, same as an empty allowed_updates
+	subscriptions = append(subscriptions, c.conf.Upstream.FilterUpdateTypes)
+
+	union := make(map[string]struct{})
+	for _, allowedUpdates := range subscriptions {
+		if len(allowedUpdates) == 0 {
+			for _, updateType := range knownUpdateTypes {
+				if !slices.Contains(defaultExcludedUpdateTypes, updateType) {
+					union[updateType] = struct{}{}
+				}
+			}
 		}
-		err = tx.Commit()
-		if err != nil {
-			debug.PrintStack()
-			log.Println("Failed to store updates:", err)
-			c.sleepUntilRetry()
-			continue
+		for _, updateType := range allowedUpdates {
+			// Update types generated by telegram-bot-mux itself are not known to the upstream
+			if !strings.HasPrefix(updateType, "tbmux_") {
+				union[updateType] = struct{}{}
+			}
 		}
+	}
 
-		c.resetRetry()
+	// If the union is exactly the default types, send an empty list so we can receive new types introduced in the future.
+	isDefault := true
+	for _, updateType := range knownUpdateTypes {
+		_, ok := union[updateType]
+		if ok == slices.Contains(defaultExcludedUpdateTypes, updateType) {
+			isDefault = false
+			break
+		}
+	}
+	filterUpdateTypes := []string{}
+	if !isDefault || len(union) != len(knownUpdateTypes)-len(defaultExcludedUpdateTypes) {
+		filterUpdateTypes = slices.Sorted(maps.Keys(union))
+	}
+
+	filterUpdateTypesBuf, err := json.Marshal(filterUpdateTypes)
+	if err != nil {
+		panic(err)
 	}
+	if string(filterUpdateTypesBuf) != c.filterUpdateTypes {
+		log.Println("Upstream allowed_updates changed to", string(filterUpdateTypesBuf))
+		c.filterUpdateTypes = string(filterUpdateTypesBuf)
+	}
+	return url.QueryEscape(c.filterUpdateTypes)
 }
 
 func (c *Client) ForwardRequest(ctx context.Context, s *Server, w http.ResponseWriter, r *http.Request, isFileRequest bool, urlSuffix string, bodyCopy io.ReadCloser) error {
@@ -238,43 +414,116 @@ func (c *Client) ForwardRequest(ctx context.Context, s *Server, w http.ResponseW
 	} else {
 		requestURL = fmt.Sprintf("%s/%s?%s", urlPrefix, urlSuffix, r.URL.RawQuery)
 	}
-	log.Printf("[HTTP %s] %s\n", r.Method, requestURL)
+	log.Printf("[HTTP %s] (%s) %s\n", r.Method, ClientFromContext(ctx).Name, requestURL)
 
+	var (
+		rateLimited bool
+		params      requestParams
+		chatID      int64
+		priority    Priority
+	)
 	if !isFileRequest {
 		// We only rate limit outgoing API calls in the echoUpdateType list.
 		if _, ok := c.echoUpdateType[urlSuffix]; ok {
-			params := struct {
-				ChatID int64 `json:"chat_id"`
-			}{}
-			_ = r.ParseForm()
-			params.ChatID, _ = strconv.ParseInt(r.Form.Get("chat_id"), 10, 64)
-
-			ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
-			if ct == "application/json" {
-				_ = json.NewDecoder(io.LimitReader(r.Body, httpBodyLimit)).Decode(&params)
+			rateLimited = true
+			params = readRequestParams(r)
+			chatID = c.resolveChatID(ctx, params["chat_id"])
+
+			priority = ClientFromContext(ctx).PriorityValue
+			if value, ok := ParsePriority(r.Header.Get("X-Tbmux-Priority")); ok {
+				priority = value
 			}
+		} else if urlSuffix == "deleteMessage" || urlSuffix == "deleteMessages" {
+			// Deleting is not rate limited, but the echo needs to know which messages are deleted
+			params = readRequestParams(r)
+			chatID = c.resolveChatID(ctx, params["chat_id"])
+		}
+	}
 
-			err := c.waitForCooldown(ctx, params.ChatID)
+	// To retry after a flood error, the request body needs to be kept until the upstream accepts it.
+	// Large uploads are spooled to disk, same as PreserveBodyReader does.
+	retryOnFlood := rateLimited && c.conf.RateLimit.RetryOnFlood
+	var spool *SpoolBuffer
+	var err error
+	if retryOnFlood && bodyCopy != nil {
+		spool = new(SpoolBuffer)
+		_, err = io.Copy(spool, bodyCopy)
+		bodyCopy.Close()
+		bodyCopy = spool
+		if err != nil {
+			spool.Close()
+			return fmt.Errorf("failed to read HTTP request: %v", err)
+		}
+	}
+
+	var resp *http.Response
+	for retry := uint64(0); ; retry++ {
+		if rateLimited {
+			err = c.waitForCooldown(ctx, chatID, priority)
 			if err != nil {
+				if bodyCopy != nil {
+					bodyCopy.Close()
+				}
 				debug.PrintStack()
 				return err
 			}
 		}
-	}
 
-	req, err := http.NewRequestWithContext(ctx, r.Method, requestURL, bodyCopy)
-	if err != nil {
-		return fmt.Errorf("failed to send HTTP request: %v", err)
-	}
-	for k, v := range r.Header {
-		if k != "Accept-Encoding" && k != "Content-Encoding" && k != "Connection" && k != "Host" && k != "Proxy-Connection" && k != "User-Agent" {
-			req.Header[k] = v
+		body := bodyCopy
+		if spool != nil {
+			body = io.NopCloser(spool.Replay())
+		}
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, r.Method, requestURL, body)
+		if err != nil {
+			if bodyCopy != nil {
+				bodyCopy.Close()
+			}
+			return fmt.Errorf("failed to send HTTP request: %v", err)
+		}
+		for k, v := range r.Header {
+			if k != "Accept-Encoding" && k != "Content-Encoding" && k != "Connection" && k != "Host" && k != "Proxy-Connection" && k != "User-Agent" && !strings.HasPrefix(k, "X-Tbmux-") {
+				req.Header[k] = v
+			}
+		}
+		if spool != nil {
+			req.ContentLength = spool.Len()
+		}
+		req.Header.Set("User-Agent", httpUserAgent)
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			if spool != nil {
+				spool.Close()
+			}
+			return fmt.Errorf("upstream HTTP request error: %v", err)
+		}
+		if isFileRequest || resp.StatusCode != http.StatusTooManyRequests {
+			break
+		}
+
+		// Flood error, hold back further requests to the same chat (or to any chat) for retry_after seconds
+		var respBody []byte
+		respBody, err = io.ReadAll(io.LimitReader(resp.Body, httpBodyLimit))
+		resp.Body.Close()
+		if err != nil {
+			if spool != nil {
+				spool.Close()
+			}
+			return fmt.Errorf("upstream HTTP request error: %v", err)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(respBody))
+		retryAfter := gjson.GetBytes(respBody, "parameters.retry_after").Int()
+		if retryAfter <= 0 {
+			break
+		}
+		log.Printf("Flood control exceeded (chat %d), retry after %d seconds\n", chatID, retryAfter)
+		c.freezeCooldown(chatID, time.Duration(retryAfter)*time.Second)
+		if !retryOnFlood || retry >= c.conf.RateLimit.MaxFloodRetries {
+			break
 		}
 	}
-	req.Header.Set("User-Agent", httpUserAgent)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("upstream HTTP request error: %v", err)
+	if spool != nil {
+		spool.Close()
 	}
 
 	respHeader := w.Header()
@@ -290,7 +539,9 @@ func (c *Client) ForwardRequest(ctx context.Context, s *Server, w http.ResponseW
 	if !isFileRequest {
 		echoUpdateType = c.echoUpdateType[urlSuffix]
 	}
-	if echoUpdateType == "" || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+	isGetChat := !isFileRequest && urlSuffix == "getChat"
+	isDelete := !isFileRequest && (urlSuffix == "deleteMessage" || urlSuffix == "deleteMessages")
+	if (echoUpdateType == "" && !isGetChat && !isDelete) || resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		_, err = io.Copy(w, resp.Body)
 		resp.Body.Close()
 		if err != nil {
@@ -308,7 +559,29 @@ func (c *Client) ForwardRequest(ctx context.Context, s *Server, w http.ResponseW
 		log.Println("HTTP error:", err)
 		return nil
 	}
-	c.processEchoMessage(echoUpdateType, respBodyCopy.Bytes())
+	if isGetChat {
+		c.processChatInfo(respBodyCopy.Bytes())
+		return nil
+	}
+	origin := &EchoOrigin{
+		Client:    ClientFromContext(ctx).Name,
+		RequestID: r.Header.Get("X-Tbmux-Request-Id"),
+		TicketID:  TicketIDFromContext(ctx),
+	}
+	if isDelete {
+		c.processEchoDelete(ctx, params, chatID, origin, respBodyCopy.Bytes())
+		return nil
+	}
+	switch urlSuffix {
+	case "forwardMessages", "copyMessage", "copyMessages":
+		c.processEchoCopy(ctx, urlSuffix, params, chatID, origin, respBodyCopy.Bytes())
+	default:
+		if _, ok := params["inline_message_id"]; ok && echoUpdateType == "edited_message" {
+			c.processEchoInlineEdit(urlSuffix, params, origin, respBodyCopy.Bytes())
+		} else {
+			c.processEchoMessage(echoUpdateType, origin, respBodyCopy.Bytes())
+		}
+	}
 	return nil
 }
 
@@ -321,93 +594,591 @@ func (c *Client) resetRetry() {
 	c.nextRetryInterval = time.Second
 }
 
-func (c *Client) processEchoMessage(updateType string, body []byte) {
+// EchoOrigin identifies the API call which caused an echo update. It is added to the update as tbmux_origin for clients with show_origin.
+type EchoOrigin struct {
+	Client    string `json:"client"`
+	RequestID string `json:"request_id,omitempty"`
+	TicketID  int64  `json:"ticket_id,omitempty"`
+}
+
+func (c *Client) processEchoMessage(updateType string, origin *EchoOrigin, body []byte) {
+	result, ok := upstreamResult(body)
+	if !ok {
+		return
+	}
+
+	c.storeEcho(func(tx *DatabaseTx) error {
+		var errs []error
+		cb := func(_, message gjson.Result) bool {
+			errs = append(errs, tx.InsertEchoUpdate(messageUpdateType(updateType, &message), message.Raw, origin))
+			errs = append(errs, tx.InsertMessage(&message))
+			return true
+		}
+		if result.IsArray() {
+			result.ForEach(cb)
+		} else if result.IsObject() {
+			cb(gjson.Result{}, result)
+		}
+		return errors.Join(errs...)
+	})
+}
+
+// upstreamResult returns the result of an upstream response.
+// If the call failed, the error is logged, and ok is false.
+func upstreamResult(body []byte) (result gjson.Result, ok bool) {
 	bodyJson := gjson.ParseBytes(body)
 	if bodyJson.Get("ok").Type != gjson.True {
 		errorCode := bodyJson.Get("error_code").String()
 		errorDesc := bodyJson.Get("description").String()
 		log.Println("Upstream error:", errorCode, errorDesc)
-		return
+		return gjson.Result{}, false
 	}
+	return bodyJson.Get("result"), true
+}
 
+// storeEcho runs store in a transaction, and logs the error if any.
+// The transaction is committed even if store fails, so the updates stored before the error are kept.
+func (c *Client) storeEcho(store func(tx *DatabaseTx) error) {
 	tx, err := c.db.BeginTx()
 	if err != nil {
 		log.Println("Failed to store updates:", err)
+		return
 	}
-	result := bodyJson.Get("result")
-	cb := func(_, message gjson.Result) bool {
-		err := tx.InsertEchoUpdate(updateType, message.Raw)
-		if err != nil {
-			debug.PrintStack()
-			log.Println("Failed to store updates:", err)
+	err = store(&tx)
+	if err != nil {
+		debug.PrintStack()
+		log.Println("Failed to store updates:", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		debug.PrintStack()
+		log.Println("Failed to store updates:", err)
+	}
+}
+
+// messageUpdateType converts "message" or "edited_message" from echoUpdateType into the update type the upstream would use for the message,
+// which depends on whether the message is in a channel or sent on behalf of a business account.
+func messageUpdateType(updateType string, message *gjson.Result) string {
+	isBusiness := message.Get("business_connection_id").Exists()
+	isChannel := message.Get("chat.type").String() == "channel"
+	switch {
+	case updateType == "message" && isBusiness:
+		return "business_message"
+	case updateType == "message" && isChannel:
+		return "channel_post"
+	case updateType == "edited_message" && isBusiness:
+		return "edited_business_message"
+	case updateType == "edited_message" && isChannel:
+		return "edited_channel_post"
+	default:
+		return updateType
+	}
+}
+
+// processEchoCopy generates echo updates for forwardMessages, copyMessage, and copyMessages.
+// The upstream only returns the IDs of the new messages, so the content is taken from the source messages we have stored.
+// The generated messages are marked with "tbmux_synthetic": true, and contain only the message ID and the chat if the source message is unknown.
+func (c *Client) processEchoCopy(ctx context.Context, method string, params requestParams, chatID int64, origin *EchoOrigin, body []byte) {
+	result, ok := upstreamResult(body)
+	if !ok {
+		return
+	}
+	if chatID == 0 {
+		return
+	}
+
+	var newIDs, sourceIDs []int64
+	if result.IsArray() {
+		for _, messageID := range result.Array() {
+			newIDs = append(newIDs, messageID.Get("message_id").Int())
 		}
-		err = tx.InsertMessage(&message)
-		if err != nil {
-			debug.PrintStack()
-			log.Println("Failed to store updates:", err)
+		for _, messageID := range gjson.Parse(params["message_ids"]).Array() {
+			sourceIDs = append(sourceIDs, messageID.Int())
 		}
-		return true
+	} else {
+		newIDs = append(newIDs, result.Get("message_id").Int())
+		sourceIDs = append(sourceIDs, gjson.Parse(params["message_id"]).Int())
 	}
-	if result.IsArray() {
-		result.ForEach(cb)
-	} else if result.IsObject() {
-		cb(gjson.Result{}, result)
+	// Messages which can't be copied are skipped by the upstream, so we can't tell which is which
+	if len(newIDs) != len(sourceIDs) {
+		sourceIDs = nil
 	}
-	err = tx.Commit()
+	fromChatID := c.resolveChatID(ctx, params["from_chat_id"])
+
+	chat, err := c.db.GetChat(ctx, chatID)
 	if err != nil {
 		debug.PrintStack()
 		log.Println("Failed to store updates:", err)
+		return
 	}
-}
+	if len(chat) == 0 {
+		// The destination chat hasn't been seen yet, look it up through getChat
+		body, err = c.queryUpstream(ctx, "getChat", url.Values{"chat_id": {strconv.FormatInt(chatID, 10)}})
+		if err != nil {
+			log.Println("Failed to retrieve chat information:", err)
+		} else if c.processChatInfo(body) == chatID {
+			chat, _ = c.db.GetChat(ctx, chatID)
+		}
+	}
+	if len(chat) == 0 {
+		chat = fmt.Sprintf(`{"id":%d}`, chatID)
+	}
+	botUser := c.getMe(ctx)
 
-func (c *Client) waitForCooldown(ctx context.Context, chatID int64) error {
-	// https://core.telegram.org/bots/faq#my-bot-is-hitting-limits-how-do-i-avoid-this
-	// Global cooldown is 1/30 sec
-	// Private chat cooldown is 1 sec
-	// Non-private chat cooldown is 3 sec
-
-	const (
-		global     = time.Second/30 + 1
-		private    = time.Second
-		nonPrivate = 3 * time.Second
-	)
+	c.storeEcho(func(tx *DatabaseTx) error {
+		var errs []error
+		for i, newID := range newIDs {
+			var source string
+			if sourceIDs != nil && fromChatID != 0 {
+				var err error
+				source, err = c.db.GetMessage(ctx, fromChatID, sourceIDs[i])
+				errs = append(errs, err)
+			}
+			message, err := synthesizeCopy(method, params, source, newID, chat, botUser)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			messageJson := gjson.Parse(message)
+			errs = append(errs, tx.InsertEchoUpdate(messageUpdateType("message", &messageJson), message, origin))
+			errs = append(errs, tx.InsertMessage(&messageJson))
+		}
+		return errors.Join(errs...)
+	})
+}
 
+// processEchoDelete generates a tbmux_deleted_messages update for deleteMessage and deleteMessages, and marks the stored messages as deleted.
+// The update has the same format as deleted_business_messages, without business_connection_id.
+func (c *Client) processEchoDelete(ctx context.Context, params requestParams, chatID int64, origin *EchoOrigin, body []byte) {
+	if _, ok := upstreamResult(body); !ok {
+		return
+	}
 	if chatID == 0 {
-		return nil
+		return
+	}
+
+	messageIDs := []int64{}
+	if messageIDsStr, ok := params["message_ids"]; ok {
+		for _, messageID := range gjson.Parse(messageIDsStr).Array() {
+			messageIDs = append(messageIDs, messageID.Int())
+		}
+	} else if messageID := gjson.Parse(params["message_id"]).Int(); messageID != 0 {
+		messageIDs = append(messageIDs, messageID)
+	}
+	if len(messageIDs) == 0 {
+		return
+	}
+
+	chat, err := c.db.GetChat(ctx, chatID)
+	if err != nil {
+		debug.PrintStack()
+		log.Println("Failed to store updates:", err)
+		return
+	}
+	if len(chat) == 0 {
+		chat = fmt.Sprintf(`{"id":%d}`, chatID)
+	}
+	update, err := json.Marshal(struct {
+		Chat       json.RawMessage `json:"chat"`
+		MessageIDs []int64         `json:"message_ids"`
+	}{
+		Chat:       json.RawMessage(chat),
+		MessageIDs: messageIDs,
+	})
+	if err != nil {
+		debug.PrintStack()
+		log.Println("Failed to store updates:", err)
+		return
 	}
 
-	chatType, err := c.db.GetChatType(ctx, chatID)
+	c.storeEcho(func(tx *DatabaseTx) error {
+		return errors.Join(
+			tx.InsertEchoUpdate("tbmux_deleted_messages", string(update), origin),
+			tx.MarkMessagesDeleted(chatID, messageIDs),
+		)
+	})
+}
+
+// processEchoInlineEdit generates a tbmux_edited_inline_message update for an edit method called with inline_message_id.
+// The upstream only returns true for inline messages, so the update is built from the request parameters.
+func (c *Client) processEchoInlineEdit(method string, params requestParams, origin *EchoOrigin, body []byte) {
+	if _, ok := upstreamResult(body); !ok {
+		return
+	}
+
+	update := map[string]any{
+		"inline_message_id": params["inline_message_id"],
+		"method":            method,
+		"date":              time.Now().Unix(),
+	}
+	for _, key := range []string{"text", "parse_mode", "caption"} {
+		if value, ok := params[key]; ok {
+			update[key] = value
+		}
+	}
+	for _, key := range []string{"entities", "link_preview_options", "caption_entities", "show_caption_above_media", "media", "reply_markup", "latitude", "longitude", "live_period", "horizontal_accuracy", "heading", "proximity_alert_radius"} {
+		if value, ok := params[key]; ok && gjson.Valid(value) {
+			update[key] = json.RawMessage(value)
+		}
+	}
+	updateBuf, err := json.Marshal(update)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve chat information: %v", err)
+		debug.PrintStack()
+		log.Println("Failed to store updates:", err)
+		return
 	}
 
-	var cd time.Duration
-	if chatType == "private" {
-		cd = private
+	c.storeEcho(func(tx *DatabaseTx) error {
+		return tx.InsertEchoUpdate("tbmux_edited_inline_message", string(updateBuf), origin)
+	})
+}
+
+// synthesizeCopy builds the Message object of a forwarded or copied message from its source message.
+func synthesizeCopy(method string, params requestParams, source string, messageID int64, chat, botUser string) (string, error) {
+	message := make(map[string]json.RawMessage)
+	if len(source) != 0 {
+		err := json.Unmarshal([]byte(source), &message)
+		if err != nil {
+			return "", err
+		}
+	}
+	sourceJson := gjson.Parse(source)
+
+	// Fields describing the source message rather than its content
+	for _, key := range []string{
+		"message_id", "message_thread_id", "from", "sender_chat", "sender_boost_count", "sender_business_bot", "date", "business_connection_id", "chat",
+		"forward_origin", "is_topic_message", "is_automatic_forward", "reply_to_message", "external_reply", "quote", "reply_to_story",
+		"edit_date", "has_protected_content", "is_from_offline", "media_group_id", "author_signature", "reply_markup", "tbmux_synthetic",
+	} {
+		delete(message, key)
+	}
+	if method == "forwardMessages" && len(source) != 0 {
+		forwardOrigin := sourceJson.Get("forward_origin").Raw
+		if len(forwardOrigin) == 0 {
+			forwardOrigin = synthesizeForwardOrigin(sourceJson)
+		}
+		message["forward_origin"] = json.RawMessage(forwardOrigin)
 	} else {
-		cd = nonPrivate
+		delete(message, "via_bot")
+	}
+	if method == "copyMessage" {
+		_, isText := message["text"]
+		if caption, ok := params["caption"]; ok && !isText {
+			// parse_mode can't be applied here, so the formatting is lost unless caption_entities is specified
+			message["caption"], _ = json.Marshal(caption)
+			delete(message, "caption_entities")
+			if entities := params["caption_entities"]; gjson.Valid(entities) && gjson.Parse(entities).IsArray() {
+				message["caption_entities"] = json.RawMessage(entities)
+			}
+		}
+		if markup := params["reply_markup"]; gjson.Valid(markup) && gjson.Parse(markup).Get("inline_keyboard").Exists() {
+			message["reply_markup"] = json.RawMessage(markup)
+		}
+	}
+	if removeCaption, _ := strconv.ParseBool(params["remove_caption"]); removeCaption && method == "copyMessages" {
+		delete(message, "caption")
+		delete(message, "caption_entities")
+	}
+
+	message["message_id"] = json.RawMessage(strconv.FormatInt(messageID, 10))
+	message["date"] = json.RawMessage(strconv.FormatInt(time.Now().Unix(), 10))
+	message["chat"] = json.RawMessage(chat)
+	if gjson.Get(chat, "type").String() == "channel" {
+		message["sender_chat"] = json.RawMessage(chat)
+	} else if len(botUser) != 0 {
+		message["from"] = json.RawMessage(botUser)
+	}
+	if threadID, err := strconv.ParseInt(params["message_thread_id"], 10, 64); err == nil {
+		message["message_thread_id"] = json.RawMessage(strconv.FormatInt(threadID, 10))
+	}
+	message["tbmux_synthetic"] = json.RawMessage("true")
+	result, err := json.Marshal(message)
+	return string(result), err
+}
+
+// synthesizeForwardOrigin builds the MessageOrigin object of a message forwarded from a message which is not a forward itself.
+func synthesizeForwardOrigin(source gjson.Result) string {
+	origin := map[string]any{
+		"date": source.Get("date").Int(),
+	}
+	if source.Get("chat.type").String() == "channel" {
+		origin["type"] = "channel"
+		origin["chat"] = json.RawMessage(source.Get("chat").Raw)
+		origin["message_id"] = source.Get("message_id").Int()
+	} else if senderChat := source.Get("sender_chat"); senderChat.Exists() {
+		origin["type"] = "chat"
+		origin["sender_chat"] = json.RawMessage(senderChat.Raw)
+	} else if from := source.Get("from"); from.Exists() {
+		origin["type"] = "user"
+		origin["sender_user"] = json.RawMessage(from.Raw)
+	} else {
+		origin["type"] = "hidden_user"
+		origin["sender_user_name"] = ""
+	}
+	if signature := source.Get("author_signature"); signature.Exists() {
+		origin["author_signature"] = signature.String()
+	}
+	result, _ := json.Marshal(origin)
+	return string(result)
+}
+
+// requestParams holds the parameters of an API call.
+// Like in a form, strings are kept as is, and other JSON values are kept in their JSON form.
+type requestParams map[string]string
+
+// readRequestParams parses the parameters of an API call from the URL query string and the body.
+// r.Body should be a PreserveBodyReader, so that the body can still be sent to the upstream.
+func readRequestParams(r *http.Request) requestParams {
+	params := make(requestParams)
+	_ = r.ParseForm()
+	for k, v := range r.Form {
+		params[k] = v[0]
 	}
 
-	c.chatCooldownMtx.Lock()
-	queue, ok := c.chatCooldown[chatID]
+	ct, ctParams, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch ct {
+	case "application/json":
+		var values map[string]json.RawMessage
+		_ = json.NewDecoder(io.LimitReader(r.Body, httpBodyLimit)).Decode(&values)
+		for k, v := range values {
+			var value string
+			if json.Unmarshal(v, &value) != nil {
+				value = string(v)
+			}
+			params[k] = value
+		}
+	case "multipart/form-data":
+		readMultipartParams(r.Body, ctParams["boundary"], params)
+	}
+	return params
+}
+
+// readMultipartParams scans a multipart/form-data body until it finds the chat_id field, and collects the non-file fields on the way.
+// Any file parts before chat_id are read through, which PreserveBodyReader spools to disk for the upstream request.
+func readMultipartParams(body io.Reader, boundary string, params requestParams) {
+	if len(boundary) == 0 {
+		return
+	}
+	mr := multipart.NewReader(body, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return
+		}
+		if len(part.FileName()) != 0 {
+			continue
+		}
+		value, err := io.ReadAll(io.LimitReader(part, httpBodyLimit))
+		if err != nil {
+			return
+		}
+		params[part.FormName()] = string(value)
+		if part.FormName() == "chat_id" {
+			return
+		}
+	}
+}
+
+// resolveChatID converts a chat_id parameter, either a numeric ID or an @username, into a numeric ID.
+// Unknown usernames are looked up through getChat. It returns 0 if the chat can't be found.
+func (c *Client) resolveChatID(ctx context.Context, chatIDStr string) int64 {
+	chatIDStr = strings.TrimSpace(chatIDStr)
+	username, ok := strings.CutPrefix(chatIDStr, "@")
 	if !ok {
-		queue = NewCooldownQueue()
-		c.chatCooldown[chatID] = queue
+		chatID, _ := strconv.ParseInt(chatIDStr, 10, 64)
+		return chatID
+	}
+	chatID, err := c.db.GetChatIDByUsername(ctx, username)
+	if err != nil {
+		debug.PrintStack()
+		log.Println("Error:", err)
+		return 0
+	}
+	if chatID != 0 {
+		return chatID
 	}
-	notify, cancel := queue.Push(cd)
-	c.chatCooldownMtx.Unlock()
+
+	body, err := c.queryUpstream(ctx, "getChat", url.Values{"chat_id": {chatIDStr}})
+	if err != nil {
+		log.Println("Failed to resolve chat:", err)
+		return 0
+	}
+	return c.processChatInfo(body)
+}
+
+// queryUpstream calls an upstream API method once on behalf of telegram-bot-mux itself, and returns the response body.
+// The call waits in the global lane of the rate limiter.
+// If the same call failed within queryFailureTTL, it fails again without calling the upstream, so a chat which can't be resolved doesn't cost an extra call every time.
+func (c *Client) queryUpstream(ctx context.Context, method string, values url.Values) ([]byte, error) {
+	requestURL := c.conf.Upstream.ApiPrefix + "/" + method
+	requestBody := values.Encode()
+	key := method + "?" + requestBody
+	now := time.Now()
+	c.mtx.Lock()
+	retryAt, failed := c.queryFailures[key]
+	if failed && now.After(retryAt) {
+		delete(c.queryFailures, key)
+		failed = false
+	}
+	c.mtx.Unlock()
+	if failed {
+		return nil, fmt.Errorf("%s failed recently, not retrying until %s", key, retryAt.Format(time.RFC3339))
+	}
+
+	// The lookup holds up the call which needs it, so it goes first
+	notify, cancel := c.cooldown.Push(0, PriorityHigh, nil)
 	select {
 	case <-notify:
 	case <-ctx.Done():
 		cancel()
-		return nil
+		return nil, ctx.Err()
+	}
+
+	body, err := c.doQueryUpstream(ctx, requestURL, requestBody)
+	if err == nil && gjson.GetBytes(body, "ok").Type != gjson.True {
+		err = fmt.Errorf("upstream error: %s %s", gjson.GetBytes(body, "error_code").String(), gjson.GetBytes(body, "description").String())
+	}
+	if err != nil && ctx.Err() == nil {
+		c.mtx.Lock()
+		for k, v := range c.queryFailures {
+			if now.After(v) {
+				delete(c.queryFailures, k)
+			}
+		}
+		c.queryFailures[key] = now.Add(queryFailureTTL)
+		c.mtx.Unlock()
+	}
+	return body, err
+}
+
+func (c *Client) doQueryUpstream(ctx context.Context, requestURL, requestBody string) ([]byte, error) {
+	log.Printf("[ HTTP POST ] %s %s\n", requestURL, requestBody)
+	req, err := http.NewRequestWithContext(ctx, "POST", requestURL, strings.NewReader(requestBody))
+	if err != nil {
+		debug.PrintStack()
+		return nil, fmt.Errorf("failed to send HTTP request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", httpUserAgent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, httpBodyLimit))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// getMe returns the User object of the bot, which is fetched from the upstream once.
+// It returns an empty string if the upstream fails.
+func (c *Client) getMe(ctx context.Context) string {
+	c.mtx.Lock()
+	botUser := c.botUser
+	c.mtx.Unlock()
+	if len(botUser) != 0 {
+		return botUser
+	}
+
+	body, err := c.queryUpstream(ctx, "getMe", url.Values{})
+	if err != nil {
+		log.Println("Failed to retrieve bot information:", err)
+		return ""
+	}
+	result := gjson.GetBytes(body, "result")
+	if !result.IsObject() {
+		return ""
+	}
+	// The User object from getMe contains the capabilities of the bot, only keep the fields seen in messages
+	botUser = result.Get("{id,is_bot,first_name,last_name,username}").Raw
+	c.mtx.Lock()
+	c.botUser = botUser
+	c.mtx.Unlock()
+	return botUser
+}
+
+// processChatInfo stores the chat returned by getChat, so that its username can be resolved later.
+// It returns the chat ID, or 0 if the call failed.
+func (c *Client) processChatInfo(body []byte) int64 {
+	result, ok := upstreamResult(body)
+	if !ok {
+		return 0
 	}
 
-	notify, cancel = c.globalCooldown.Push(global)
+	// ChatFullInfo contains a lot more than we need, only keep the fields of a Chat
+	chat := result.Get("{id,type,title,username,first_name,last_name,is_forum}")
+	chatID := chat.Get("id").Int()
+	if chatID == 0 {
+		return 0
+	}
+	tx, err := c.db.BeginTx()
+	if err != nil {
+		log.Println("Failed to store chat:", err)
+		return chatID
+	}
+	err = tx.InsertChat(&chat)
+	if err != nil {
+		debug.PrintStack()
+		log.Println("Failed to store chat:", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		debug.PrintStack()
+		log.Println("Failed to store chat:", err)
+	}
+	return chatID
+}
+
+// freezeCooldown stops sending to a chat for the specified duration after a flood error.
+// If chatID is 0, sending to all chats is stopped instead.
+func (c *Client) freezeCooldown(chatID int64, d time.Duration) {
+	c.cooldown.Freeze(chatID, time.Now().Add(d))
+}
+
+func (c *Client) waitForCooldown(ctx context.Context, chatID int64, priority Priority) error {
+	// https://core.telegram.org/bots/faq#my-bot-is-hitting-limits-how-do-i-avoid-this
+	// The default rules are configured in config.go
+
+	// A call without a known chat only waits in the global lane, which is still held back by a flood error
+	rl := &c.conf.RateLimit
+	var rules []ConfigTokenBucket
+	if chatID == 0 {
+		rules = nil
+	} else if rule, ok := rl.ChatsByID[chatID]; ok {
+		rules = []ConfigTokenBucket{rule}
+	} else {
+		chatType, err := c.db.GetChatType(ctx, chatID)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve chat information: %v", err)
+		}
+		switch chatType {
+		case "private":
+			rules = []ConfigTokenBucket{rl.Private}
+		case "channel":
+			rules = []ConfigTokenBucket{rl.Channel}
+		case "supergroup":
+			rules = []ConfigTokenBucket{rl.Supergroup}
+		default:
+			// Unknown chats are treated as groups
+			rules = []ConfigTokenBucket{rl.Group}
+		}
+		if chatType != "private" && chatType != "channel" && rl.GroupPerMinute != 0 {
+			rules = append(rules, ConfigTokenBucket{Interval: 60 / float64(rl.GroupPerMinute), Burst: rl.GroupPerMinute})
+		}
+	}
+
+	notify, cancel := c.cooldown.Push(chatID, priority, rules)
+	waitCtx := WaitContextFromContext(ctx)
 	select {
 	case <-notify:
 	case <-ctx.Done():
 		cancel()
+	case <-waitCtx.Done():
+		// The outbox entry is canceled before it leaves the rate limiter
+		cancel()
+		return fmt.Errorf("canceled while waiting for rate limiting: %v", waitCtx.Err())
 	}
 
 	return nil
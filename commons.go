@@ -9,5 +9,39 @@ const (
 	httpUserAgent = "Mozilla/5.0 Telegram-bot-mux/1.0 (+https://github.com/m13253/telegram-bot-mux)"
 )
 
+// All update types known to this version, in the order listed in https://core.telegram.org/bots/api#update
+var knownUpdateTypes = []string{
+	"message",
+	"edited_message",
+	"channel_post",
+	"edited_channel_post",
+	"business_connection",
+	"business_message",
+	"edited_business_message",
+	"deleted_business_messages",
+	"message_reaction",
+	"message_reaction_count",
+	"inline_query",
+	"chosen_inline_result",
+	"callback_query",
+	"shipping_query",
+	"pre_checkout_query",
+	"purchased_paid_media",
+	"poll",
+	"poll_answer",
+	"my_chat_member",
+	"chat_member",
+	"chat_join_request",
+	"chat_boost",
+	"removed_chat_boost",
+}
+
+// When allowed_updates is empty, the official API server sends all update types except these.
+var defaultExcludedUpdateTypes = []string{"chat_member", "message_reaction", "message_reaction_count"}
+
+// Update types generated by telegram-bot-mux itself.
+// Like chat_member, they are only sent to clients who list them in allowed_updates, since stock libraries don't know them.
+var tbmuxUpdateTypes = []string{"tbmux_deleted_messages", "tbmux_edited_inline_message"}
+
 //go:embed webconsole/index.html
 var webConsoleBody []byte
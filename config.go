@@ -3,38 +3,127 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"maps"
 	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/BurntSushi/toml"
 )
 
 type Config struct {
-	DB         string           `toml:"db"`
-	Upstream   ConfigUpstream   `toml:"upstream"`
-	Downstream ConfigDownstream `toml:"downstream"`
+	DB string `toml:"db"`
+	// Settings of the default bot, which are also the defaults of [[bots]]
+	ConfigBot
+	BotsPrimitive []toml.Primitive `toml:"bots"`
+	Bots          []*ConfigBot     `toml:"-"`
+}
+
+type ConfigBot struct {
+	Name        string           `toml:"name"`
+	DBNamespace *string          `toml:"db_namespace"`
+	Upstream    ConfigUpstream   `toml:"upstream"`
+	Downstream  ConfigDownstream `toml:"downstream"`
+	Retention   ConfigRetention  `toml:"retention"`
+	RateLimit   ConfigRateLimit  `toml:"ratelimit"`
 }
 
 type ConfigUpstream struct {
-	ApiUrl               string   `toml:"api_url"`
-	FileUrl              string   `toml:"file_url"`
-	AuthToken            string   `toml:"auth_token"`
-	PollingTimeout       uint64   `toml:"polling_timeout"`
-	MaxRetryInterval     uint64   `toml:"max_retry_interval"`
-	FilterUpdateTypes    []string `toml:"filter_update_types"`
-	ApiPrefix            string   `toml:"-"`
-	FilePrefix           string   `toml:"-"`
-	FilterUpdateTypesStr string   `toml:"-"`
+	ApiUrl                string   `toml:"api_url"`
+	FileUrl               string   `toml:"file_url"`
+	AuthToken             string   `toml:"auth_token"`
+	Mode                  string   `toml:"mode"`
+	PollingTimeout        uint64   `toml:"polling_timeout"`
+	WebhookURL            string   `toml:"webhook_url"`
+	WebhookPath           string   `toml:"webhook_path"`
+	WebhookSecretToken    string   `toml:"webhook_secret_token"`
+	WebhookMaxConnections uint64   `toml:"webhook_max_connections"`
+	MaxRetryInterval      uint64   `toml:"max_retry_interval"`
+	FilterUpdateTypes     []string `toml:"filter_update_types"`
+	AutoFilterUpdateTypes bool     `toml:"auto_filter_update_types"`
+	ApiPrefix             string   `toml:"-"`
+	FilePrefix            string   `toml:"-"`
+	FilterUpdateTypesStr  string   `toml:"-"`
 }
 
 type ConfigDownstream struct {
-	ListenAddr string   `toml:"listen_addr"`
-	ApiPath    string   `toml:"api_path"`
-	FilePath   string   `toml:"file_path"`
-	AuthToken  string   `toml:"auth_token"`
-	ApiPrefix  []string `toml:"-"`
-	FilePrefix []string `toml:"-"`
+	ListenAddr     string                   `toml:"listen_addr"`
+	ApiPath        string                   `toml:"api_path"`
+	FilePath       string                   `toml:"file_path"`
+	AuthToken      string                   `toml:"auth_token"`
+	Clients        []ConfigClient           `toml:"clients"`
+	ApiPrefix      []string                 `toml:"-"`
+	FilePrefix     []string                 `toml:"-"`
+	ClientsByToken map[string]*ConfigClient `toml:"-"`
+	ClientsByName  map[string]*ConfigClient `toml:"-"`
+	Groups         []ConfigGroup            `toml:"groups"`
+	GroupsByName   map[string]*ConfigGroup  `toml:"-"`
+}
+
+type ConfigRetention struct {
+	Interval      uint64            `toml:"interval"`
+	MaxAge        uint64            `toml:"max_age"`
+	MaxAgeByType  map[string]uint64 `toml:"max_age_by_type"`
+	MaxUpdates    uint64            `toml:"max_updates"`
+	MessageMaxAge uint64            `toml:"message_max_age"`
+	MaxMessages   uint64            `toml:"max_messages"`
+	OutboxMaxAge  uint64            `toml:"outbox_max_age"`
+}
+
+type ConfigRateLimit struct {
+	RetryOnFlood      bool                         `toml:"retry_on_flood"`
+	MaxFloodRetries   uint64                       `toml:"max_flood_retries"`
+	StarvationTimeout uint64                       `toml:"starvation_timeout"`
+	Global            ConfigTokenBucket            `toml:"global"`
+	Private           ConfigTokenBucket            `toml:"private"`
+	Group             ConfigTokenBucket            `toml:"group"`
+	Supergroup        ConfigTokenBucket            `toml:"supergroup"`
+	Channel           ConfigTokenBucket            `toml:"channel"`
+	GroupPerMinute    uint64                       `toml:"group_per_minute"`
+	Chats             map[string]ConfigTokenBucket `toml:"chats"`
+	ChatsByID         map[int64]ConfigTokenBucket  `toml:"-"`
+}
+
+// ConfigTokenBucket allows up to Burst calls at once, and earns one more every Interval seconds.
+type ConfigTokenBucket struct {
+	Interval float64 `toml:"interval"`
+	Burst    uint64  `toml:"burst"`
+}
+
+type ConfigClient struct {
+	Name             string       `toml:"name"`
+	AuthToken        string       `toml:"auth_token"`
+	Priority         string       `toml:"priority"`
+	SuppressSelfEcho bool         `toml:"suppress_self_echo"`
+	ShowOrigin       bool         `toml:"show_origin"`
+	Group            string       `toml:"group"`
+	PriorityValue    Priority     `toml:"-"`
+	GroupValue       *ConfigGroup `toml:"-"`
+}
+
+// ConfigGroup is a consumer group, whose members share one cursor, and each update is leased to only one of them.
+type ConfigGroup struct {
+	Name              string   `toml:"name"`
+	VisibilityTimeout uint64   `toml:"visibility_timeout"`
+	SuppressSelfEcho  bool     `toml:"suppress_self_echo"`
+	Members           []string `toml:"-"`
+}
+
+// ExcludedOrigins returns the client names whose echo updates are hidden from this client.
+// For a member of a consumer group, the setting of the group applies to echoes from all of its members.
+func (client *ConfigClient) ExcludedOrigins() []string {
+	switch {
+	case client == nil:
+		return []string{}
+	case client.GroupValue != nil && client.GroupValue.SuppressSelfEcho:
+		return client.GroupValue.Members
+	case client.GroupValue == nil && client.SuppressSelfEcho:
+		return []string{client.Name}
+	default:
+		return []string{}
+	}
 }
 
 func Load(path string) (*Config, error) {
@@ -45,19 +134,38 @@ func Load(path string) (*Config, error) {
 	d := toml.NewDecoder(file)
 	conf := &Config{
 		DB: "tbmux.db",
-		Upstream: ConfigUpstream{
-			ApiUrl:            "https://api.telegram.org/bot",
-			FileUrl:           "https://api.telegram.org/file/bot",
-			PollingTimeout:    60,
-			MaxRetryInterval:  600,
-			FilterUpdateTypes: []string{},
-		},
-		Downstream: ConfigDownstream{
-			ApiPath:  "/bot",
-			FilePath: "/file/bot",
+		ConfigBot: ConfigBot{
+			Upstream: ConfigUpstream{
+				ApiUrl:                "https://api.telegram.org/bot",
+				FileUrl:               "https://api.telegram.org/file/bot",
+				Mode:                  "polling",
+				PollingTimeout:        60,
+				WebhookMaxConnections: 40,
+				MaxRetryInterval:      600,
+				FilterUpdateTypes:     []string{},
+			},
+			Downstream: ConfigDownstream{
+				ApiPath:  "/bot",
+				FilePath: "/file/bot",
+			},
+			Retention: ConfigRetention{
+				Interval:     3600,
+				MaxAgeByType: map[string]uint64{},
+			},
+			RateLimit: ConfigRateLimit{
+				MaxFloodRetries:   3,
+				StarvationTimeout: 30,
+				Global:            ConfigTokenBucket{Interval: 1.0 / 30, Burst: 1},
+				Private:           ConfigTokenBucket{Interval: 1, Burst: 1},
+				Group:             ConfigTokenBucket{Interval: 3, Burst: 1},
+				Supergroup:        ConfigTokenBucket{Interval: 3, Burst: 1},
+				Channel:           ConfigTokenBucket{Interval: 3, Burst: 1},
+				GroupPerMinute:    20,
+				Chats:             map[string]ConfigTokenBucket{},
+			},
 		},
 	}
-	_, err = d.Decode(conf)
+	md, err := d.Decode(conf)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load config file: %v", err)
 	}
@@ -66,70 +174,287 @@ func Load(path string) (*Config, error) {
 	if len(conf.DB) == 0 {
 		return nil, &errConfigFieldIsEmpty{field: "db"}
 	}
-	if len(conf.Upstream.ApiUrl) == 0 {
-		return nil, &errConfigFieldIsEmpty{field: "upstream.api_url"}
+	if len(conf.Downstream.ListenAddr) == 0 {
+		return nil, &errConfigFieldIsEmpty{field: "downstream.listen_addr"}
 	}
-	if len(conf.Upstream.FileUrl) == 0 {
-		return nil, &errConfigFieldIsEmpty{field: "upstream.file_url"}
+
+	if len(conf.BotsPrimitive) == 0 {
+		// Only one bot, using the top-level settings
+		bot := conf.ConfigBot
+		if bot.DBNamespace == nil {
+			bot.DBNamespace = new(string)
+		}
+		err = bot.load("")
+		if err != nil {
+			return nil, err
+		}
+		conf.Bots = []*ConfigBot{&bot}
+	} else {
+		// Multiple bots, the top-level settings serve as their defaults
+		if len(conf.Upstream.AuthToken) != 0 {
+			return nil, fmt.Errorf("invalid config file: upstream.auth_token cannot be used together with [[bots]]")
+		}
+		if len(conf.Downstream.AuthToken) != 0 || len(conf.Downstream.Clients) != 0 || len(conf.Downstream.Groups) != 0 {
+			return nil, fmt.Errorf("invalid config file: downstream.auth_token, downstream.clients, and downstream.groups cannot be used together with [[bots]]")
+		}
+		for i, primitive := range conf.BotsPrimitive {
+			bot := conf.ConfigBot
+			bot.Name = ""
+			bot.DBNamespace = nil
+			bot.Upstream.FilterUpdateTypes = slices.Clone(bot.Upstream.FilterUpdateTypes)
+			bot.Retention.MaxAgeByType = maps.Clone(bot.Retention.MaxAgeByType)
+			bot.RateLimit.Chats = maps.Clone(bot.RateLimit.Chats)
+			bot.Downstream.ListenAddr = ""
+			err = md.PrimitiveDecode(primitive, &bot)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load config file: %v", err)
+			}
+			prefix := fmt.Sprintf("bots[%d].", i)
+			// All bots share the top-level HTTP server
+			if len(bot.Downstream.ListenAddr) != 0 {
+				return nil, fmt.Errorf("invalid config file: %sdownstream.listen_addr cannot be set for each bot, use the top-level downstream.listen_addr", prefix)
+			}
+			bot.Downstream.ListenAddr = conf.Downstream.ListenAddr
+			if len(bot.Name) == 0 {
+				return nil, &errConfigFieldIsEmpty{field: prefix + "name"}
+			}
+			if bot.DBNamespace == nil {
+				bot.DBNamespace = &bot.Name
+			}
+			err = bot.load(prefix)
+			if err != nil {
+				return nil, err
+			}
+			conf.Bots = append(conf.Bots, &bot)
+		}
 	}
-	if len(conf.Upstream.AuthToken) == 0 {
-		return nil, &errConfigFieldIsEmpty{field: "upstream.auth_token"}
+
+	// Bots share the same HTTP server and database file
+	botNames := make(map[string]struct{}, len(conf.Bots))
+	dbNamespaces := make(map[string]struct{}, len(conf.Bots))
+	webhookPaths := make(map[string]struct{}, len(conf.Bots))
+	clientTokens := make(map[string]struct{})
+	for i, bot := range conf.Bots {
+		if _, ok := botNames[bot.Name]; ok {
+			return nil, &errConfigFieldIsDuplicate{field: fmt.Sprintf("bots[%d].name", i)}
+		}
+		botNames[bot.Name] = struct{}{}
+		if strings.ContainsFunc(*bot.DBNamespace, func(r rune) bool {
+			return !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_')
+		}) {
+			return nil, fmt.Errorf("invalid config file: bots[%d].db_namespace must only contain letters, digits, and underscores", i)
+		}
+		// Table names are prefixed with the namespace, and SQLite reserves names starting with "sqlite_"
+		if len(*bot.DBNamespace) != 0 && (*bot.DBNamespace)[0] >= '0' && (*bot.DBNamespace)[0] <= '9' {
+			return nil, fmt.Errorf("invalid config file: bots[%d].db_namespace must not start with a digit", i)
+		}
+		if strings.HasPrefix(strings.ToLower(*bot.DBNamespace)+"_", "sqlite_") {
+			return nil, fmt.Errorf("invalid config file: bots[%d].db_namespace must not be \"sqlite\" or start with \"sqlite_\"", i)
+		}
+		if _, ok := dbNamespaces[*bot.DBNamespace]; ok {
+			return nil, &errConfigFieldIsDuplicate{field: fmt.Sprintf("bots[%d].db_namespace", i)}
+		}
+		dbNamespaces[*bot.DBNamespace] = struct{}{}
+		if bot.Upstream.Mode == "webhook" {
+			if _, ok := webhookPaths[bot.Upstream.WebhookPath]; ok {
+				return nil, &errConfigFieldIsDuplicate{field: fmt.Sprintf("bots[%d].upstream.webhook_path", i)}
+			}
+			webhookPaths[bot.Upstream.WebhookPath] = struct{}{}
+		}
+		for token := range bot.Downstream.ClientsByToken {
+			if _, ok := clientTokens[token]; ok {
+				return nil, fmt.Errorf("invalid config file: bots[%d].downstream.clients has an auth_token used by another bot", i)
+			}
+			clientTokens[token] = struct{}{}
+		}
 	}
-	if conf.Upstream.PollingTimeout < 10 {
-		return nil, &errConfigDurationIsTooShort{field: "upstream.polling_timeout"}
+	return conf, nil
+}
+
+// load checks a bot for errors and fills in the computed fields.
+// prefix is prepended to field names in error messages.
+func (bot *ConfigBot) load(prefix string) error {
+	if len(bot.Upstream.ApiUrl) == 0 {
+		return &errConfigFieldIsEmpty{field: prefix + "upstream.api_url"}
 	}
-	if conf.Upstream.MaxRetryInterval < 60 {
-		return nil, &errConfigDurationIsTooShort{field: "upstream.max_retry_interval"}
+	if len(bot.Upstream.FileUrl) == 0 {
+		return &errConfigFieldIsEmpty{field: prefix + "upstream.file_url"}
 	}
-	if len(conf.Downstream.ListenAddr) == 0 {
-		return nil, &errConfigFieldIsEmpty{field: "downstream.listen_addr"}
+	if len(bot.Upstream.AuthToken) == 0 {
+		return &errConfigFieldIsEmpty{field: prefix + "upstream.auth_token"}
 	}
-	if len(conf.Downstream.ApiPath) == 0 {
-		return nil, &errConfigFieldIsEmpty{field: "downstream.api_path"}
+	switch bot.Upstream.Mode {
+	case "polling":
+	case "webhook":
+		if len(bot.Upstream.WebhookURL) == 0 {
+			return &errConfigFieldIsEmpty{field: prefix + "upstream.webhook_url"}
+		}
+		if len(bot.Upstream.WebhookPath) == 0 {
+			return &errConfigFieldIsEmpty{field: prefix + "upstream.webhook_path"}
+		}
+		if !strings.HasPrefix(bot.Upstream.WebhookPath, "/") {
+			return fmt.Errorf("invalid config file: %supstream.webhook_path must start with \"/\"", prefix)
+		}
+		if len(bot.Upstream.WebhookSecretToken) == 0 {
+			return &errConfigFieldIsEmpty{field: prefix + "upstream.webhook_secret_token"}
+		}
+		// The upstream only accepts 1-256 characters of A-Z, a-z, 0-9, "_", and "-"
+		if len(bot.Upstream.WebhookSecretToken) > 256 || strings.ContainsFunc(bot.Upstream.WebhookSecretToken, func(r rune) bool {
+			return !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-')
+		}) {
+			return fmt.Errorf("invalid config file: %supstream.webhook_secret_token must be up to 256 letters, digits, underscores, and hyphens", prefix)
+		}
+		if bot.Upstream.WebhookMaxConnections == 0 || bot.Upstream.WebhookMaxConnections > 100 {
+			return fmt.Errorf("invalid config file: %supstream.webhook_max_connections must be between 1 and 100", prefix)
+		}
+	default:
+		return fmt.Errorf("invalid config file: %supstream.mode must be either \"polling\" or \"webhook\"", prefix)
+	}
+	if bot.Upstream.PollingTimeout < 10 {
+		return &errConfigDurationIsTooShort{field: prefix + "upstream.polling_timeout"}
+	}
+	if bot.Upstream.MaxRetryInterval < 60 {
+		return &errConfigDurationIsTooShort{field: prefix + "upstream.max_retry_interval"}
+	}
+	if bot.Retention.Interval < 60 {
+		return &errConfigDurationIsTooShort{field: prefix + "retention.interval"}
+	}
+	for name, bucket := range map[string]ConfigTokenBucket{
+		"global":     bot.RateLimit.Global,
+		"private":    bot.RateLimit.Private,
+		"group":      bot.RateLimit.Group,
+		"supergroup": bot.RateLimit.Supergroup,
+		"channel":    bot.RateLimit.Channel,
+	} {
+		err := bucket.check(prefix + "ratelimit." + name)
+		if err != nil {
+			return err
+		}
 	}
-	if len(conf.Downstream.FilePath) == 0 {
-		return nil, &errConfigFieldIsEmpty{field: "downstream.file_path"}
+	bot.RateLimit.ChatsByID = make(map[int64]ConfigTokenBucket, len(bot.RateLimit.Chats))
+	for key, bucket := range bot.RateLimit.Chats {
+		chatID, err := strconv.ParseInt(key, 10, 64)
+		if err != nil || chatID == 0 {
+			return fmt.Errorf("invalid config file: %sratelimit.chats has an invalid chat ID %q", prefix, key)
+		}
+		err = bucket.check(fmt.Sprintf("%sratelimit.chats.%q", prefix, key))
+		if err != nil {
+			return err
+		}
+		bot.RateLimit.ChatsByID[chatID] = bucket
 	}
-	if len(conf.Downstream.AuthToken) == 0 {
-		return nil, &errConfigFieldIsEmpty{field: "downstream.auth_token"}
+	if len(bot.Downstream.ApiPath) == 0 {
+		return &errConfigFieldIsEmpty{field: prefix + "downstream.api_path"}
+	}
+	if len(bot.Downstream.FilePath) == 0 {
+		return &errConfigFieldIsEmpty{field: prefix + "downstream.file_path"}
+	}
+
+	// The legacy downstream.auth_token is treated as a client named "default"
+	if len(bot.Downstream.AuthToken) != 0 {
+		bot.Downstream.Clients = append(bot.Downstream.Clients, ConfigClient{
+			Name:      "default",
+			AuthToken: bot.Downstream.AuthToken,
+		})
+	}
+	if len(bot.Downstream.Clients) == 0 {
+		return &errConfigFieldIsEmpty{field: prefix + "downstream.clients"}
+	}
+	bot.Downstream.GroupsByName = make(map[string]*ConfigGroup, len(bot.Downstream.Groups))
+	for i := range bot.Downstream.Groups {
+		group := &bot.Downstream.Groups[i]
+		if len(group.Name) == 0 {
+			return &errConfigFieldIsEmpty{field: fmt.Sprintf("%sdownstream.groups[%d].name", prefix, i)}
+		}
+		if _, ok := bot.Downstream.GroupsByName[group.Name]; ok {
+			return &errConfigFieldIsDuplicate{field: fmt.Sprintf("%sdownstream.groups[%d].name", prefix, i)}
+		}
+		if group.VisibilityTimeout == 0 {
+			group.VisibilityTimeout = 60
+		}
+		bot.Downstream.GroupsByName[group.Name] = group
+	}
+	bot.Downstream.ClientsByName = make(map[string]*ConfigClient, len(bot.Downstream.Clients))
+	bot.Downstream.ClientsByToken = make(map[string]*ConfigClient, len(bot.Downstream.Clients))
+	for i := range bot.Downstream.Clients {
+		client := &bot.Downstream.Clients[i]
+		if len(client.Name) == 0 {
+			return &errConfigFieldIsEmpty{field: fmt.Sprintf("%sdownstream.clients[%d].name", prefix, i)}
+		}
+		if len(client.AuthToken) == 0 {
+			return &errConfigFieldIsEmpty{field: fmt.Sprintf("%sdownstream.clients[%d].auth_token", prefix, i)}
+		}
+		if len(client.Priority) == 0 {
+			client.Priority = "normal"
+		}
+		var ok bool
+		client.PriorityValue, ok = ParsePriority(client.Priority)
+		if !ok {
+			return fmt.Errorf("invalid config file: %sdownstream.clients[%d].priority must be \"high\", \"normal\", or \"low\"", prefix, i)
+		}
+		if len(client.Group) != 0 {
+			client.GroupValue = bot.Downstream.GroupsByName[client.Group]
+			if client.GroupValue == nil {
+				return fmt.Errorf("invalid config file: %sdownstream.clients[%d].group is not found in %sdownstream.groups", prefix, i, prefix)
+			}
+			client.GroupValue.Members = append(client.GroupValue.Members, client.Name)
+		}
+		if _, ok := bot.Downstream.ClientsByName[client.Name]; ok {
+			return &errConfigFieldIsDuplicate{field: fmt.Sprintf("%sdownstream.clients[%d].name", prefix, i)}
+		}
+		bot.Downstream.ClientsByName[client.Name] = client
+		if _, ok := bot.Downstream.ClientsByToken[client.AuthToken]; ok {
+			return &errConfigFieldIsDuplicate{field: fmt.Sprintf("%sdownstream.clients[%d].auth_token", prefix, i)}
+		}
+		bot.Downstream.ClientsByToken[client.AuthToken] = client
 	}
 
 	// Join prefixes
-	conf.Upstream.ApiPrefix = conf.Upstream.ApiUrl + url.PathEscape(conf.Upstream.AuthToken)
-	conf.Upstream.FilePrefix = conf.Upstream.FileUrl + url.PathEscape(conf.Upstream.AuthToken)
+	bot.Upstream.ApiPrefix = bot.Upstream.ApiUrl + url.PathEscape(bot.Upstream.AuthToken)
+	bot.Upstream.FilePrefix = bot.Upstream.FileUrl + url.PathEscape(bot.Upstream.AuthToken)
 
 	// Convert FilterUpdateTypes to string
-	filterUpdateTypesBuf, err := json.Marshal(conf.Upstream.FilterUpdateTypes)
+	filterUpdateTypesBuf, err := json.Marshal(bot.Upstream.FilterUpdateTypes)
 	if err != nil {
-		return nil, fmt.Errorf("invalid config file: upstream.filter_update_types is invalid: %v", err)
+		return fmt.Errorf("invalid config file: %supstream.filter_update_types is invalid: %v", prefix, err)
 	}
-	conf.Upstream.FilterUpdateTypesStr = url.QueryEscape(string(filterUpdateTypesBuf))
+	bot.Upstream.FilterUpdateTypesStr = url.QueryEscape(string(filterUpdateTypesBuf))
 
 	// Split prefixes
-	apiPrefix, err := url.ParseRequestURI(conf.Downstream.ApiPath)
+	apiPrefix, err := url.ParseRequestURI(bot.Downstream.ApiPath)
 	if err != nil {
-		return nil, fmt.Errorf("invalid config file: downstream.api_path is invalid: %v", err)
+		return fmt.Errorf("invalid config file: %sdownstream.api_path is invalid: %v", prefix, err)
 	}
-	conf.Downstream.ApiPrefix = strings.Split(apiPrefix.EscapedPath(), "/")
-	for i := range conf.Downstream.ApiPrefix {
-		conf.Downstream.ApiPrefix[i], err = url.PathUnescape(conf.Downstream.ApiPrefix[i])
+	bot.Downstream.ApiPrefix = strings.Split(apiPrefix.EscapedPath(), "/")
+	for i := range bot.Downstream.ApiPrefix {
+		bot.Downstream.ApiPrefix[i], err = url.PathUnescape(bot.Downstream.ApiPrefix[i])
 		if err != nil {
-			return nil, fmt.Errorf("invalid config file: downstream.api_path is invalid: %v", err)
+			return fmt.Errorf("invalid config file: %sdownstream.api_path is invalid: %v", prefix, err)
 		}
 	}
 
-	filePrefix, err := url.ParseRequestURI(conf.Downstream.FilePath)
+	filePrefix, err := url.ParseRequestURI(bot.Downstream.FilePath)
 	if err != nil {
-		return nil, fmt.Errorf("invalid config file: downstream.file_path is invalid: %v", err)
+		return fmt.Errorf("invalid config file: %sdownstream.file_path is invalid: %v", prefix, err)
 	}
-	conf.Downstream.FilePrefix = strings.Split(filePrefix.EscapedPath(), "/")
-	for i := range conf.Downstream.FilePrefix {
-		conf.Downstream.FilePrefix[i], err = url.PathUnescape(conf.Downstream.FilePrefix[i])
+	bot.Downstream.FilePrefix = strings.Split(filePrefix.EscapedPath(), "/")
+	for i := range bot.Downstream.FilePrefix {
+		bot.Downstream.FilePrefix[i], err = url.PathUnescape(bot.Downstream.FilePrefix[i])
 		if err != nil {
-			return nil, fmt.Errorf("invalid config file: downstream.file_path is invalid: %v", err)
+			return fmt.Errorf("invalid config file: %sdownstream.file_path is invalid: %v", prefix, err)
 		}
 	}
-	return conf, nil
+	return nil
+}
+
+func (bucket *ConfigTokenBucket) check(field string) error {
+	if bucket.Interval <= 0 {
+		return &errConfigDurationIsTooShort{field: field + ".interval"}
+	}
+	if bucket.Burst == 0 {
+		return fmt.Errorf("invalid config file: %s.burst must be at least 1", field)
+	}
+	return nil
 }
 
 type errConfigFieldIsEmpty struct {
@@ -147,3 +472,11 @@ type errConfigDurationIsTooShort struct {
 func (e *errConfigDurationIsTooShort) Error() string {
 	return fmt.Sprintf("invalid config file: %s is too short", e.field)
 }
+
+type errConfigFieldIsDuplicate struct {
+	field string
+}
+
+func (e *errConfigFieldIsDuplicate) Error() string {
+	return fmt.Sprintf("invalid config file: %s is duplicate", e.field)
+}
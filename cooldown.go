@@ -1,95 +1,357 @@
 package main
 
 import (
-	"log"
+	"container/heap"
+	"math"
+	"slices"
 	"sync"
 	"time"
 )
 
-type CooldownQueueItem struct {
-	notify   chan<- struct{}
-	cooldown time.Duration
-}
-
-type CooldownQueue struct {
-	mtx            sync.Mutex
-	queue          map[uint64]CooldownQueueItem
-	front          uint64
-	back           uint64
-	lastPop        time.Time
-	interruptWaker chan<- struct{}
-	wakerRunning   bool
-}
-
-func NewCooldownQueue() *CooldownQueue {
-	return &CooldownQueue{
-		mtx:            sync.Mutex{},
-		queue:          make(map[uint64]CooldownQueueItem),
-		front:          0,
-		back:           0,
-		lastPop:        time.Time{},
-		interruptWaker: nil,
-		wakerRunning:   false,
-	}
-}
-
-func (q *CooldownQueue) Push(cooldown time.Duration) (notify <-chan struct{}, cancel func()) {
-	c := make(chan struct{})
-	q.mtx.Lock()
-	token := q.back
-	q.back++
-	q.queue[token] = CooldownQueueItem{notify: c, cooldown: cooldown}
-	if !q.wakerRunning {
-		q.wakerRunning = true
-		go q.waker()
-	}
-	q.mtx.Unlock()
-	return c, func() {
-		q.mtx.Lock()
-		delete(q.queue, token)
-		if q.interruptWaker != nil {
-			close(q.interruptWaker)
+// CooldownScheduler paces outgoing API calls of all chats using a single goroutine.
+//
+// Each chat has a lane, and so does the whole bot. A call first waits in the lane of its chat, then in the global lane.
+// A lane lets a call through when every token bucket of the lane has a token.
+// Lanes are kept in a min-heap ordered by the time they become ready, and an idle lane is evicted once its buckets are full again.
+// Inside a lane, calls with a higher priority go first, but a call waiting longer than starvationTimeout takes every other turn.
+type CooldownScheduler struct {
+	mtx               sync.Mutex
+	global            *cooldownLane
+	chats             map[int64]*cooldownLane
+	lanes             cooldownHeap
+	wake              chan struct{}
+	starvationTimeout time.Duration
+}
+
+type Priority int
+
+const (
+	PriorityHigh Priority = iota
+	PriorityNormal
+	PriorityLow
+	priorityCount
+)
+
+type cooldownLane struct {
+	chatID      int64
+	queues      [priorityCount][]*cooldownTicket
+	lastStarved bool
+	buckets     []tokenBucket
+	frozenUntil time.Time
+	readyAt     time.Time
+	heapIndex   int
+}
+
+type tokenBucket struct {
+	ConfigTokenBucket
+	tokens  float64
+	updated time.Time
+}
+
+type cooldownTicket struct {
+	notify   chan struct{}
+	lane     *cooldownLane
+	priority Priority
+	enqueued time.Time
+}
+
+// CooldownStatus is the number of calls waiting in each lane.
+type CooldownStatus struct {
+	Global int             `json:"global"`
+	Chats  []CooldownChats `json:"chats"`
+}
+
+type CooldownChats struct {
+	ChatID  int64 `json:"chat_id"`
+	Pending int   `json:"pending"`
+}
+
+// ParsePriority converts "high", "normal", or "low" into a Priority.
+func ParsePriority(s string) (Priority, bool) {
+	switch s {
+	case "high":
+		return PriorityHigh, true
+	case "normal":
+		return PriorityNormal, true
+	case "low":
+		return PriorityLow, true
+	default:
+		return PriorityNormal, false
+	}
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	default:
+		return "normal"
+	}
+}
+
+func NewCooldownScheduler(global ConfigTokenBucket, starvationTimeout time.Duration) *CooldownScheduler {
+	s := &CooldownScheduler{
+		mtx:               sync.Mutex{},
+		global:            &cooldownLane{heapIndex: -1},
+		chats:             make(map[int64]*cooldownLane),
+		lanes:             nil,
+		wake:              make(chan struct{}, 1),
+		starvationTimeout: starvationTimeout,
+	}
+	s.global.setRules([]ConfigTokenBucket{global})
+	go s.run()
+	return s
+}
+
+// Push queues a call to chatID, which becomes ready after both the chat and the global lanes have tokens.
+// rules are the token buckets of the chat, which replace the previous ones if they are different.
+// If chatID is 0, the call only waits in the global lane, and rules are ignored.
+func (s *CooldownScheduler) Push(chatID int64, priority Priority, rules []ConfigTokenBucket) (notify <-chan struct{}, cancel func()) {
+	t := &cooldownTicket{
+		notify:   make(chan struct{}),
+		lane:     nil,
+		priority: priority,
+		enqueued: time.Time{},
+	}
+	s.mtx.Lock()
+	lane := s.global
+	if chatID != 0 {
+		lane = s.chatLane(chatID)
+		lane.setRules(rules)
+	}
+	s.enqueue(lane, t)
+	s.mtx.Unlock()
+	s.notify()
+	return t.notify, func() {
+		s.mtx.Lock()
+		if lane := t.lane; lane != nil {
+			lane.queues[t.priority] = slices.DeleteFunc(lane.queues[t.priority], func(item *cooldownTicket) bool { return item == t })
+			t.lane = nil
+			s.update(lane)
+		}
+		s.mtx.Unlock()
+	}
+}
+
+// Freeze holds back every call to chatID until the specified time.
+// If chatID is 0, all calls are held back instead.
+func (s *CooldownScheduler) Freeze(chatID int64, until time.Time) {
+	s.mtx.Lock()
+	lane := s.global
+	if chatID != 0 {
+		lane = s.chatLane(chatID)
+	}
+	if until.After(lane.frozenUntil) {
+		lane.frozenUntil = until
+		s.update(lane)
+	}
+	s.mtx.Unlock()
+	s.notify()
+}
+
+// Status returns the number of calls waiting in the global lane and in each chat lane.
+func (s *CooldownScheduler) Status() CooldownStatus {
+	s.mtx.Lock()
+	status := CooldownStatus{
+		Global: s.global.pending(),
+		Chats:  []CooldownChats{},
+	}
+	for chatID, lane := range s.chats {
+		if pending := lane.pending(); pending != 0 {
+			status.Chats = append(status.Chats, CooldownChats{ChatID: chatID, Pending: pending})
+		}
+	}
+	s.mtx.Unlock()
+	slices.SortFunc(status.Chats, func(a, b CooldownChats) int { return b.Pending - a.Pending })
+	return status
+}
+
+func (s *CooldownScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *CooldownScheduler) chatLane(chatID int64) *cooldownLane {
+	lane, ok := s.chats[chatID]
+	if !ok {
+		lane = &cooldownLane{chatID: chatID, heapIndex: -1}
+		s.chats[chatID] = lane
+	}
+	return lane
+}
+
+func (s *CooldownScheduler) enqueue(lane *cooldownLane, t *cooldownTicket) {
+	t.lane = lane
+	t.enqueued = time.Now()
+	lane.queues[t.priority] = append(lane.queues[t.priority], t)
+	s.update(lane)
+}
+
+// update recomputes when a lane becomes ready, or idle if it has nothing queued.
+func (s *CooldownScheduler) update(lane *cooldownLane) {
+	now := time.Now()
+	readyAt := now
+	for i := range lane.buckets {
+		bucket := &lane.buckets[i]
+		bucket.refill(now)
+		// An idle lane is only evicted once the bucket is full, otherwise a new call could take more tokens than it should
+		need := 1.0
+		if lane.pending() == 0 {
+			need = float64(bucket.Burst)
+		}
+		if bucket.tokens < need {
+			bucketReadyAt := now.Add(time.Duration((need - bucket.tokens) * bucket.Interval * float64(time.Second)))
+			if bucketReadyAt.After(readyAt) {
+				readyAt = bucketReadyAt
+			}
 		}
-		q.mtx.Unlock()
+	}
+	if lane.frozenUntil.After(readyAt) {
+		readyAt = lane.frozenUntil
+	}
+	lane.readyAt = readyAt
+	if lane.heapIndex < 0 {
+		heap.Push(&s.lanes, lane)
+	} else {
+		heap.Fix(&s.lanes, lane.heapIndex)
 	}
 }
 
-func (q *CooldownQueue) waker() {
-	q.mtx.Lock()
-	for q.front < q.back {
-		if item, ok := q.queue[q.front]; ok {
-			var dur time.Duration
-			if !q.lastPop.IsZero() {
-				dur = time.Until(q.lastPop.Add(item.cooldown))
+func (s *CooldownScheduler) run() {
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		}
+
+		s.mtx.Lock()
+		now := time.Now()
+		for len(s.lanes) != 0 && !s.lanes[0].readyAt.After(now) {
+			lane := s.lanes[0]
+			if lane.pending() == 0 {
+				// The lane has cooled down with nothing queued, forget about it
+				heap.Pop(&s.lanes)
+				if lane != s.global {
+					delete(s.chats, lane.chatID)
+				}
+				continue
 			}
-			if dur <= 0 {
-				q.lastPop = time.Now()
-				close(item.notify)
-				delete(q.queue, q.front)
-				q.front++
+			t := s.pop(lane, now)
+			for i := range lane.buckets {
+				lane.buckets[i].refill(now)
+				lane.buckets[i].tokens--
+			}
+			s.update(lane)
+			if lane != s.global {
+				s.enqueue(s.global, t)
 			} else {
-				sleep := time.After(dur)
-				interrupt := make(chan struct{})
-				q.interruptWaker = interrupt
-				q.mtx.Unlock()
-				log.Println("Cooldown", dur)
-				select {
-				case <-sleep:
-					q.mtx.Lock()
-					q.interruptWaker = nil
-					q.lastPop = time.Now()
-					close(item.notify)
-					delete(q.queue, q.front)
-					q.front++
-				case <-interrupt:
-					q.mtx.Lock()
-					q.interruptWaker = nil
-				}
+				t.lane = nil
+				close(t.notify)
 			}
-		} else {
-			q.front++
 		}
+		if len(s.lanes) != 0 {
+			timer.Reset(time.Until(s.lanes[0].readyAt))
+		}
+		s.mtx.Unlock()
+	}
+}
+
+// pop removes the next ticket from a non-empty lane.
+func (s *CooldownScheduler) pop(lane *cooldownLane, now time.Time) *cooldownTicket {
+	priority := PriorityHigh
+	for len(lane.queues[priority]) == 0 {
+		priority++
 	}
-	q.wakerRunning = false
-	q.mtx.Unlock()
+	if lane.lastStarved {
+		lane.lastStarved = false
+	} else {
+		// Let the longest waiting call of a lower priority take this turn if it is starving
+		for p := priority + 1; p < priorityCount; p++ {
+			if len(lane.queues[p]) != 0 && now.Sub(lane.queues[p][0].enqueued) > s.starvationTimeout && lane.queues[p][0].enqueued.Before(lane.queues[priority][0].enqueued) {
+				priority = p
+				lane.lastStarved = true
+			}
+		}
+	}
+	t := lane.queues[priority][0]
+	lane.queues[priority][0] = nil
+	lane.queues[priority] = lane.queues[priority][1:]
+	return t
+}
+
+func (lane *cooldownLane) pending() int {
+	n := 0
+	for _, queue := range lane.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+func (lane *cooldownLane) setRules(rules []ConfigTokenBucket) {
+	if slices.EqualFunc(lane.buckets, rules, func(bucket tokenBucket, rule ConfigTokenBucket) bool {
+		return bucket.ConfigTokenBucket == rule
+	}) {
+		return
+	}
+	// The new buckets keep the tokens left in the lane, so learning the type of a chat doesn't let an extra burst through.
+	// The buckets of a new lane start full.
+	now := time.Now()
+	tokens := math.Inf(1)
+	for i := range lane.buckets {
+		lane.buckets[i].refill(now)
+		tokens = min(tokens, lane.buckets[i].tokens)
+	}
+	lane.buckets = make([]tokenBucket, len(rules))
+	for i, rule := range rules {
+		lane.buckets[i] = tokenBucket{
+			ConfigTokenBucket: rule,
+			tokens:            min(tokens, float64(rule.Burst)),
+			updated:           now,
+		}
+	}
+}
+
+func (bucket *tokenBucket) refill(now time.Time) {
+	if !bucket.updated.IsZero() {
+		bucket.tokens = min(bucket.tokens+now.Sub(bucket.updated).Seconds()/bucket.Interval, float64(bucket.Burst))
+	}
+	bucket.updated = now
+}
+
+// cooldownHeap implements heap.Interface, with the earliest ready lane on the top.
+type cooldownHeap []*cooldownLane
+
+func (h cooldownHeap) Len() int {
+	return len(h)
+}
+
+func (h cooldownHeap) Less(i, j int) bool {
+	return h[i].readyAt.Before(h[j].readyAt)
+}
+
+func (h cooldownHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *cooldownHeap) Push(x any) {
+	lane := x.(*cooldownLane)
+	lane.heapIndex = len(*h)
+	*h = append(*h, lane)
+}
+
+func (h *cooldownHeap) Pop() any {
+	old := *h
+	lane := old[len(old)-1]
+	old[len(old)-1] = nil
+	lane.heapIndex = -1
+	*h = old[:len(old)-1]
+	return lane
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed cron expression with 5 fields: minute, hour, day of month, month, and day of week.
+// Each field supports "*", numbers, ranges "a-b", steps "*/n" or "a-b/n", and lists separated by commas.
+type CronSchedule struct {
+	minute     uint64
+	hour       uint64
+	dayOfMonth uint64
+	month      uint64
+	dayOfWeek  uint64
+	// If both day of month and day of week are restricted, a day matching either of them matches
+	dayOfMonthIsStar bool
+	dayOfWeekIsStar  bool
+}
+
+func ParseCron(expr string) (*CronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+	c := &CronSchedule{}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("invalid minute: %v", err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("invalid hour: %v", err)
+	}
+	if c.dayOfMonth, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("invalid day of month: %v", err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("invalid month: %v", err)
+	}
+	if c.dayOfWeek, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("invalid day of week: %v", err)
+	}
+	// Both 0 and 7 mean Sunday
+	if c.dayOfWeek&(1<<7) != 0 {
+		c.dayOfWeek |= 1
+	}
+	c.dayOfMonthIsStar = strings.HasPrefix(fields[2], "*")
+	c.dayOfWeekIsStar = strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+func parseCronField(field string, low, high int) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(field, ",") {
+		rangeStr, stepStr, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+		start, end := low, high
+		if rangeStr != "*" {
+			startStr, endStr, isRange := strings.Cut(rangeStr, "-")
+			var err error
+			start, err = strconv.Atoi(startStr)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", startStr)
+			}
+			end = start
+			if isRange {
+				end, err = strconv.Atoi(endStr)
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %q", endStr)
+				}
+			} else if hasStep {
+				end = high
+			}
+		}
+		if start < low || end > high || start > end {
+			return 0, fmt.Errorf("%q is out of range %d-%d", item, low, high)
+		}
+		for i := start; i <= end; i += step {
+			set |= 1 << i
+		}
+	}
+	return set, nil
+}
+
+// Next returns the first time after t matching the schedule, in the location of t.
+// A wall time skipped by a daylight saving transition runs at the end of the gap, and a repeated wall time runs only once.
+// It returns the zero time if nothing matches within 5 years, for example "0 0 30 2 *".
+func (c *CronSchedule) Next(t time.Time) time.Time {
+	// The search runs on the wall clock expressed in UTC, which has no daylight saving transitions
+	wall := wallClock(t).Truncate(time.Minute).Add(time.Minute)
+	limit := wall.AddDate(5, 0, 0)
+	for {
+		wall = c.nextWall(wall, limit)
+		if wall.IsZero() {
+			return time.Time{}
+		}
+		if next := wallToTime(wall, t.Location()); next.After(t) {
+			return next
+		}
+		wall = wall.Add(time.Minute)
+	}
+}
+
+// nextWall returns the first wall time at or after t matching the schedule, or the zero time if there is none before limit.
+func (c *CronSchedule) nextWall(t, limit time.Time) time.Time {
+	for t.Before(limit) {
+		if c.month&(1<<int(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if c.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.UTC)
+			continue
+		}
+		if c.minute&(1<<t.Minute()) == 0 {
+			// Jump to the next matching minute within this hour, if any
+			next := c.minute >> t.Minute()
+			if next == 0 {
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.UTC)
+			} else {
+				t = t.Add(time.Duration(bits.TrailingZeros64(next)) * time.Minute)
+			}
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// wallClock returns the wall time of t as the same wall time in UTC.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// wallToTime returns the wall time in loc, or the end of the gap if a daylight saving transition skips it.
+func wallToTime(wall time.Time, loc *time.Location) time.Time {
+	t := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), 0, 0, loc)
+	switch got := wallClock(t); {
+	case got.Before(wall):
+		_, end := t.ZoneBounds()
+		return end
+	case got.After(wall):
+		start, _ := t.ZoneBounds()
+		return start
+	}
+	return t
+}
+
+func (c *CronSchedule) matchDay(t time.Time) bool {
+	dayOfMonth := c.dayOfMonth&(1<<t.Day()) != 0
+	dayOfWeek := c.dayOfWeek&(1<<int(t.Weekday())) != 0
+	if c.dayOfMonthIsStar || c.dayOfWeekIsStar {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseCronFields(t *testing.T) {
+	tests := []struct {
+		expr string
+		want CronSchedule
+	}{
+		{"0 0 1 1 0", CronSchedule{minute: 1 << 0, hour: 1 << 0, dayOfMonth: 1 << 1, month: 1 << 1, dayOfWeek: 1 << 0}},
+		{"5,10 1-3 */10 2-12/5 7", CronSchedule{minute: 1<<5 | 1<<10, hour: 1<<1 | 1<<2 | 1<<3, dayOfMonth: 1<<1 | 1<<11 | 1<<21 | 1<<31, month: 1<<2 | 1<<7 | 1<<12, dayOfWeek: 1<<0 | 1<<7, dayOfMonthIsStar: true}},
+		{"* * * * *", CronSchedule{minute: 1<<60 - 1, hour: 1<<24 - 1, dayOfMonth: 1<<32 - 2, month: 1<<13 - 2, dayOfWeek: 1<<8 - 1, dayOfMonthIsStar: true, dayOfWeekIsStar: true}},
+		{"0 12 */2 * 1", CronSchedule{minute: 1, hour: 1 << 12, dayOfMonth: 0xaaaaaaaa, month: 1<<13 - 2, dayOfWeek: 1 << 1, dayOfMonthIsStar: true}},
+	}
+	for _, tt := range tests {
+		c, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		if *c != tt.want {
+			t.Errorf("ParseCron(%q) = %+v, want %+v", tt.expr, *c, tt.want)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1- * * * *",
+		"1,,2 * * * *",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"every minute", "* * * * *", time.Date(2026, 1, 1, 10, 0, 30, 0, time.UTC), time.Date(2026, 1, 1, 10, 1, 0, 0, time.UTC)},
+		{"exact match is skipped", "0 10 * * *", time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC), time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)},
+		{"next minute in hour", "15,45 * * * *", time.Date(2026, 1, 1, 10, 20, 0, 0, time.UTC), time.Date(2026, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"next month", "0 0 1 * *", time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC), time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"next year", "0 0 1 1 *", time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"leap day", "0 0 29 2 *", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"never", "0 0 30 2 *", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Time{}},
+		{"weekdays", "0 8 * * 1-5", time.Date(2026, 1, 2, 9, 0, 0, 0, time.UTC), time.Date(2026, 1, 5, 8, 0, 0, 0, time.UTC)},
+		{"sunday as 7", "0 0 * * 7", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 1, 4, 0, 0, 0, 0, time.UTC)},
+		{"day of month or day of week", "0 0 13 * 5", time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC), time.Date(2026, 1, 9, 0, 0, 0, 0, time.UTC)},
+		{"day of month or day of week by month", "0 0 13 * 5", time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC), time.Date(2026, 1, 13, 0, 0, 0, 0, time.UTC)},
+		{"day of month and star day of week", "0 0 13 * *", time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC), time.Date(2026, 1, 13, 0, 0, 0, 0, time.UTC)},
+		{"star step day of month and day of week", "0 0 */10 * 5", time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC), time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"time zone", "0 8 * * *", time.Date(2026, 1, 1, 12, 0, 0, 0, newYork), time.Date(2026, 1, 2, 8, 0, 0, 0, newYork)},
+		{"daily across spring forward", "0 8 * * *", time.Date(2026, 3, 7, 12, 0, 0, 0, newYork), time.Date(2026, 3, 8, 12, 0, 0, 0, time.UTC)},
+		{"hourly across spring forward", "0 * * * *", time.Date(2026, 3, 8, 6, 30, 0, 0, time.UTC).In(newYork), time.Date(2026, 3, 8, 7, 0, 0, 0, time.UTC)},
+		{"hourly after spring forward", "0 * * * *", time.Date(2026, 3, 8, 7, 0, 0, 0, time.UTC).In(newYork), time.Date(2026, 3, 8, 8, 0, 0, 0, time.UTC)},
+		{"skipped local time runs at end of gap", "30 2 * * *", time.Date(2026, 3, 7, 12, 0, 0, 0, newYork), time.Date(2026, 3, 8, 7, 0, 0, 0, time.UTC)},
+		{"skipped local time runs next day", "30 2 * * *", time.Date(2026, 3, 8, 7, 0, 0, 0, time.UTC).In(newYork), time.Date(2026, 3, 9, 6, 30, 0, 0, time.UTC)},
+		{"daily across fall back", "0 8 * * *", time.Date(2026, 10, 31, 12, 0, 0, 0, newYork), time.Date(2026, 11, 1, 13, 0, 0, 0, time.UTC)},
+		{"repeated local time runs once", "30 1 * * *", time.Date(2026, 11, 1, 5, 0, 0, 0, time.UTC).In(newYork), time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC)},
+		{"repeated local time is not run again", "30 1 * * *", time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC).In(newYork), time.Date(2026, 11, 2, 6, 30, 0, 0, time.UTC)},
+		{"hourly across fall back", "0 * * * *", time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC).In(newYork), time.Date(2026, 11, 1, 7, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		c, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: ParseCron(%q): %v", tt.name, tt.expr, err)
+		}
+		if got := c.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%s: Next(%v) = %v, want %v", tt.name, tt.from, got, tt.want)
+		}
+	}
+}
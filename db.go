@@ -3,9 +3,13 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"iter"
 	"log"
+	"maps"
+	"regexp"
+	"slices"
 	"sync"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -14,9 +18,12 @@ import (
 
 type Database struct {
 	conn            *sql.DB
+	namespace       string
 	updateMutex     *sync.Mutex
 	updateQueue     map[uint64]chan<- struct{}
 	nextCancelToken uint64
+	// Serializes leasing, so two members of a consumer group never lease the same update
+	leaseMutex *sync.Mutex
 }
 
 type DatabaseTx struct {
@@ -25,7 +32,8 @@ type DatabaseTx struct {
 	updated bool
 }
 
-func OpenDatabase(conf *Config) (*Database, error) {
+// OpenDatabase opens the database file shared by all bots.
+func OpenDatabase(conf *Config) (*sql.DB, error) {
 	conn, err := sql.Open("sqlite3", conf.DB)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %v", err)
@@ -34,22 +42,108 @@ func OpenDatabase(conf *Config) (*Database, error) {
 		"PRAGMA journal_mode = WAL;\n" +
 			"PRAGMA journal_size_limit = 0;\n" +
 			"PRAGMA wal_autocheckpoint = 1;\n" +
-			"PRAGMA optimize = 0x10002;\n" +
-			"BEGIN TRANSACTION;\n" +
-			"CREATE TABLE IF NOT EXISTS chats (id INTEGER PRIMARY KEY, chat JSONB NOT NULL);\n" +
-			"CREATE TABLE IF NOT EXISTS messages (id INTEGER PRIMARY KEY, chat_id INTEGER NOT NULL, message_id INTEGER NOT NULL, message JSONB NOT NULL, UNIQUE(chat_id, message_id));\n" +
-			"CREATE TABLE IF NOT EXISTS updates (id INTEGER PRIMARY KEY, upstream_id INTEGER UNIQUE, type TEXT NOT NULL, \"update\" JSONB NOT NULL);\n" +
-			"COMMIT;\n" +
-			"PRAGMA optimize;",
+			"PRAGMA optimize = 0x10002;",
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to write to database: %v", err)
 	}
-	return &Database{
+	return conn, nil
+}
+
+// NewDatabase creates the tables of a bot inside its namespace.
+// The default namespace is empty, so databases created by older versions can be used as is.
+func NewDatabase(conn *sql.DB, namespace string) (*Database, error) {
+	d := &Database{
 		conn:        conn,
+		namespace:   namespace,
 		updateQueue: make(map[uint64]chan<- struct{}),
 		updateMutex: new(sync.Mutex),
-	}, nil
+		leaseMutex:  new(sync.Mutex),
+	}
+	_, err := conn.Exec(d.q(
+		"BEGIN TRANSACTION;\n" +
+			"CREATE TABLE IF NOT EXISTS {chats} (id INTEGER PRIMARY KEY, chat JSONB NOT NULL);\n" +
+			"CREATE INDEX IF NOT EXISTS {chats_username} ON {chats} (lower(json_extract(chat, '$.username')));\n" +
+			"CREATE TABLE IF NOT EXISTS {messages} (id INTEGER PRIMARY KEY, chat_id INTEGER NOT NULL, message_id INTEGER NOT NULL, message JSONB NOT NULL, UNIQUE(chat_id, message_id));\n" +
+			"CREATE TABLE IF NOT EXISTS {updates} (id INTEGER PRIMARY KEY, upstream_id INTEGER UNIQUE, type TEXT NOT NULL, \"update\" JSONB NOT NULL);\n" +
+			"CREATE TABLE IF NOT EXISTS {consumers} (name TEXT PRIMARY KEY, \"offset\" INTEGER NOT NULL);\n" +
+			"CREATE TABLE IF NOT EXISTS {settings} (key TEXT PRIMARY KEY, value);\n" +
+			"CREATE TABLE IF NOT EXISTS {outbox} (id INTEGER PRIMARY KEY, client TEXT NOT NULL, method TEXT NOT NULL, query TEXT NOT NULL, content_type TEXT NOT NULL, body BLOB NOT NULL, priority INTEGER NOT NULL, status TEXT NOT NULL, created_date INTEGER NOT NULL, sent_date INTEGER, http_status INTEGER, response TEXT);\n" +
+			"CREATE INDEX IF NOT EXISTS {outbox_status} ON {outbox} (status, priority, id);\n" +
+			"CREATE TABLE IF NOT EXISTS {broadcasts} (id INTEGER PRIMARY KEY, client TEXT NOT NULL, method TEXT NOT NULL, status TEXT NOT NULL, created_date INTEGER NOT NULL);\n" +
+			"CREATE TABLE IF NOT EXISTS {schedules} (id INTEGER PRIMARY KEY, client TEXT NOT NULL, method TEXT NOT NULL, body BLOB NOT NULL, priority INTEGER NOT NULL, send_at INTEGER NOT NULL, cron TEXT NOT NULL, timezone TEXT NOT NULL, status TEXT NOT NULL, created_date INTEGER NOT NULL, fire_count INTEGER NOT NULL DEFAULT 0, last_ticket_id INTEGER);\n" +
+			"CREATE INDEX IF NOT EXISTS {schedules_send_at} ON {schedules} (send_at) WHERE status = 'active';\n" +
+			"CREATE TABLE IF NOT EXISTS {consumer_groups} (name TEXT PRIMARY KEY, \"offset\" INTEGER NOT NULL, allowed_updates TEXT);\n" +
+			"CREATE TABLE IF NOT EXISTS {group_leases} (group_name TEXT NOT NULL, update_id INTEGER NOT NULL, member TEXT NOT NULL, lease_until INTEGER NOT NULL, acked INTEGER NOT NULL DEFAULT 0, delivery_count INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (group_name, update_id));\n" +
+			"COMMIT;\n" +
+			"PRAGMA optimize;",
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to database: %v", err)
+	}
+	for _, column := range [][3]string{
+		{"{consumers}", "allowed_updates", "TEXT"},
+		{"{consumers}", "webhook_url", "TEXT"},
+		{"{consumers}", "webhook_secret_token", "TEXT"},
+		{"{consumers}", "webhook_max_connections", "INTEGER"},
+		{"{consumers}", "webhook_last_error_date", "INTEGER"},
+		{"{consumers}", "webhook_last_error_message", "TEXT"},
+		{"{updates}", "date", "INTEGER"},
+		{"{outbox}", "broadcast_id", "INTEGER"},
+		{"{outbox}", "chat_id", "INTEGER"},
+		{"{messages}", "deleted_date", "INTEGER"},
+		{"{updates}", "origin", "BLOB"},
+		{"{outbox}", "request_id", "TEXT"},
+		{"{schedules}", "request_id", "TEXT"},
+	} {
+		err = addColumnIfNotExists(conn, d.q(column[0]), column[1], column[2])
+		if err != nil {
+			return nil, fmt.Errorf("failed to write to database: %v", err)
+		}
+	}
+	_, err = conn.Exec(d.q("CREATE INDEX IF NOT EXISTS {outbox_broadcast} ON {outbox} (broadcast_id) WHERE broadcast_id IS NOT NULL;"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to database: %v", err)
+	}
+	// Older versions indexed pending entries by (status, id) only
+	var count int
+	err = conn.QueryRow("SELECT count(*) FROM pragma_index_info(?) WHERE name = 'priority';", d.q("{outbox_status}")).Scan(&count)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from database: %v", err)
+	}
+	if count == 0 {
+		_, err = conn.Exec(d.q(
+			"BEGIN TRANSACTION;\n" +
+				"DROP INDEX IF EXISTS {outbox_status};\n" +
+				"CREATE INDEX {outbox_status} ON {outbox} (status, priority, id);\n" +
+				"COMMIT;",
+		))
+		if err != nil {
+			return nil, fmt.Errorf("failed to write to database: %v", err)
+		}
+	}
+	return d, nil
+}
+
+var sqlTableNamePattern = regexp.MustCompile(`\{(\w+)\}`)
+
+// q replaces table names written as {name} with the ones inside the namespace of this bot.
+func (d *Database) q(query string) string {
+	if len(d.namespace) == 0 {
+		return sqlTableNamePattern.ReplaceAllString(query, "$1")
+	}
+	return sqlTableNamePattern.ReplaceAllString(query, d.namespace+"_$1")
+}
+
+// addColumnIfNotExists upgrades a table created by an older version.
+func addColumnIfNotExists(conn *sql.DB, table, column, definition string) error {
+	var count int
+	err := conn.QueryRow("SELECT count(*) FROM pragma_table_info(?) WHERE name = ?;", table, column).Scan(&count)
+	if err != nil || count != 0 {
+		return err
+	}
+	_, err = conn.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %q %s;", table, column, definition))
+	return err
 }
 
 func (d *Database) SubscribeNextUpdate() (notify <-chan struct{}, cancel func()) {
@@ -75,38 +169,476 @@ func (d *Database) NotifyUpdates() {
 	d.updateMutex.Unlock()
 }
 
-func (d *Database) GetLastUpdateID(ctx context.Context) (uint64, error) {
+type Consumer struct {
+	// The first unconfirmed update_id
+	Offset int64
+	// Update types the consumer subscribed to, nil means the default types
+	AllowedUpdates []string
+	// Empty if the consumer uses getUpdates
+	WebhookURL              string
+	WebhookSecretToken      string
+	WebhookMaxConnections   uint64
+	WebhookLastErrorDate    int64
+	WebhookLastErrorMessage string
+}
+
+// GetConsumer returns the cursor and subscription of a downstream client.
+// A client seen for the first time starts from the next incoming update.
+func (d *Database) GetConsumer(ctx context.Context, name string) (*Consumer, error) {
 	// Some client libraries poll from 0, other poll from 1, so we start our real updates from update_id = 2
-	stmt, err := d.conn.PrepareContext(ctx, "SELECT id + 1 FROM updates ORDER BY id DESC LIMIT 1;")
+	stmt, err := d.conn.PrepareContext(ctx, d.q("INSERT INTO {consumers} (name, \"offset\") VALUES (?, (SELECT coalesce(max(id), 0) + 2 FROM {updates})) ON CONFLICT (name) DO NOTHING;"))
 	if err != nil {
-		return 0, fmt.Errorf("database error: %v", err)
+		return nil, fmt.Errorf("database error: %v", err)
 	}
-	var id uint64
-	err = stmt.QueryRowContext(ctx).Scan(&id)
+	_, err = stmt.ExecContext(ctx, name)
 	stmt.Close()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return 1, nil
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+
+	stmt, err = d.conn.PrepareContext(ctx, d.q("SELECT \"offset\", allowed_updates, coalesce(webhook_url, ''), coalesce(webhook_secret_token, ''), coalesce(webhook_max_connections, 0), coalesce(webhook_last_error_date, 0), coalesce(webhook_last_error_message, '') FROM {consumers} WHERE name = ?;"))
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	var consumer Consumer
+	var allowedUpdates sql.NullString
+	err = stmt.QueryRowContext(ctx, name).Scan(&consumer.Offset, &allowedUpdates, &consumer.WebhookURL, &consumer.WebhookSecretToken, &consumer.WebhookMaxConnections, &consumer.WebhookLastErrorDate, &consumer.WebhookLastErrorMessage)
+	stmt.Close()
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	if allowedUpdates.Valid {
+		err = json.Unmarshal([]byte(allowedUpdates.String), &consumer.AllowedUpdates)
+		if err != nil {
+			return nil, fmt.Errorf("database error: %v", err)
+		}
+	}
+	return &consumer, nil
+}
+
+// SetConsumerAllowedUpdates remembers the update types a downstream client subscribed to.
+// An empty list resets the subscription to the default types.
+func (d *Database) SetConsumerAllowedUpdates(ctx context.Context, name string, allowedUpdates []string) error {
+	var allowedUpdatesStr sql.NullString
+	if len(allowedUpdates) != 0 {
+		buf, err := json.Marshal(allowedUpdates)
+		if err != nil {
+			return fmt.Errorf("database error: %v", err)
+		}
+		allowedUpdatesStr = sql.NullString{String: string(buf), Valid: true}
+	}
+	stmt, err := d.conn.PrepareContext(ctx, d.q("UPDATE {consumers} SET allowed_updates = ? WHERE name = ?;"))
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, allowedUpdatesStr, name)
+	stmt.Close()
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+// SetConsumerWebhook registers a push URL for a downstream client.
+// An empty webhookURL switches the client back to getUpdates.
+func (d *Database) SetConsumerWebhook(ctx context.Context, name, webhookURL, secretToken string, maxConnections uint64) error {
+	stmt, err := d.conn.PrepareContext(ctx, d.q("UPDATE {consumers} SET webhook_url = nullif(?, ''), webhook_secret_token = ?, webhook_max_connections = ?, webhook_last_error_date = NULL, webhook_last_error_message = NULL WHERE name = ?;"))
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, webhookURL, secretToken, maxConnections, name)
+	stmt.Close()
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+// SetConsumerWebhookError records the last failed webhook delivery of a downstream client.
+func (d *Database) SetConsumerWebhookError(ctx context.Context, name string, date int64, message string) error {
+	stmt, err := d.conn.PrepareContext(ctx, d.q("UPDATE {consumers} SET webhook_last_error_date = ?, webhook_last_error_message = ? WHERE name = ?;"))
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, date, message, name)
+	stmt.Close()
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+// GetWebhookConsumers returns the names of all downstream clients with a webhook.
+func (d *Database) GetWebhookConsumers(ctx context.Context) ([]string, error) {
+	stmt, err := d.conn.PrepareContext(ctx, d.q("SELECT name FROM {consumers} WHERE webhook_url IS NOT NULL;"))
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		stmt.Close()
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	var result []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			rows.Close()
+			stmt.Close()
+			return nil, fmt.Errorf("database error: %v", err)
+		}
+		result = append(result, name)
+	}
+	err = rows.Err()
+	rows.Close()
+	stmt.Close()
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	return result, nil
+}
+
+// GetConsumersAllowedUpdates returns the subscriptions of the specified downstream clients who have ever polled.
+// A nil entry means the client subscribed to the default types.
+func (d *Database) GetConsumersAllowedUpdates(ctx context.Context, names []string) ([][]string, error) {
+	namesStr, err := json.Marshal(names)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	stmt, err := d.conn.PrepareContext(ctx, d.q("SELECT allowed_updates FROM {consumers} WHERE name IN (SELECT value FROM json_each(?));"))
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	rows, err := stmt.QueryContext(ctx, string(namesStr))
+	if err != nil {
+		stmt.Close()
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	var result [][]string
+	for rows.Next() {
+		var allowedUpdatesStr sql.NullString
+		var allowedUpdates []string
+		err = rows.Scan(&allowedUpdatesStr)
+		if err == nil && allowedUpdatesStr.Valid {
+			err = json.Unmarshal([]byte(allowedUpdatesStr.String), &allowedUpdates)
+		}
+		if err != nil {
+			rows.Close()
+			stmt.Close()
+			return nil, fmt.Errorf("database error: %v", err)
+		}
+		result = append(result, allowedUpdates)
+	}
+	err = rows.Err()
+	rows.Close()
+	stmt.Close()
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	return result, nil
+}
+
+// ConfirmUpdates marks all updates with update_id < offset as consumed by a downstream client.
+func (d *Database) ConfirmUpdates(ctx context.Context, name string, offset int64) error {
+	stmt, err := d.conn.PrepareContext(ctx, d.q("UPDATE {consumers} SET \"offset\" = max(\"offset\", ?) WHERE name = ?;"))
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, offset, name)
+	stmt.Close()
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+// DropPendingUpdates confirms all existing updates for a downstream client.
+func (d *Database) DropPendingUpdates(ctx context.Context, name string) error {
+	stmt, err := d.conn.PrepareContext(ctx, d.q("UPDATE {consumers} SET \"offset\" = max(\"offset\", (SELECT coalesce(max(id), 0) + 2 FROM {updates})) WHERE name = ?;"))
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, name)
+	stmt.Close()
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+// ConsumerGroup is the shared cursor of a consumer group.
+// Offset is the first update not yet confirmed by any member, later updates may already be confirmed.
+type ConsumerGroup struct {
+	Offset int64
+	// Update types the group subscribed to, nil means the default types
+	AllowedUpdates []string
+}
+
+// GetConsumerGroup returns the shared cursor and subscription of a consumer group.
+// A group seen for the first time starts from the next incoming update.
+func (d *Database) GetConsumerGroup(ctx context.Context, name string) (*ConsumerGroup, error) {
+	stmt, err := d.conn.PrepareContext(ctx, d.q("INSERT INTO {consumer_groups} (name, \"offset\") VALUES (?, (SELECT coalesce(max(id), 0) + 2 FROM {updates})) ON CONFLICT (name) DO NOTHING;"))
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, name)
+	stmt.Close()
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+
+	stmt, err = d.conn.PrepareContext(ctx, d.q("SELECT \"offset\", allowed_updates FROM {consumer_groups} WHERE name = ?;"))
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	var group ConsumerGroup
+	var allowedUpdates sql.NullString
+	err = stmt.QueryRowContext(ctx, name).Scan(&group.Offset, &allowedUpdates)
+	stmt.Close()
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	if allowedUpdates.Valid {
+		err = json.Unmarshal([]byte(allowedUpdates.String), &group.AllowedUpdates)
+		if err != nil {
+			return nil, fmt.Errorf("database error: %v", err)
+		}
+	}
+	return &group, nil
+}
+
+// SetConsumerGroupAllowedUpdates remembers the update types a consumer group subscribed to.
+// An empty list resets the subscription to the default types.
+func (d *Database) SetConsumerGroupAllowedUpdates(ctx context.Context, name string, allowedUpdates []string) error {
+	var allowedUpdatesStr sql.NullString
+	if len(allowedUpdates) != 0 {
+		buf, err := json.Marshal(allowedUpdates)
+		if err != nil {
+			return fmt.Errorf("database error: %v", err)
+		}
+		allowedUpdatesStr = sql.NullString{String: string(buf), Valid: true}
+	}
+	stmt, err := d.conn.PrepareContext(ctx, d.q("UPDATE {consumer_groups} SET allowed_updates = ? WHERE name = ?;"))
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, allowedUpdatesStr, name)
+	stmt.Close()
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+// ConfirmGroupUpdates marks the updates with update_id < offset leased to a member as consumed.
+// Then the shared cursor moves forward to the first update not yet confirmed by any member.
+func (d *Database) ConfirmGroupUpdates(ctx context.Context, groupName, member string, offset int64, allowedUpdates, excludedOrigins []string) error {
+	allowedUpdatesStr, excludedUpdatesStr, err := marshalUpdateTypeFilter(allowedUpdates)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	excludedOriginsStr, err := json.Marshal(excludedOrigins)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	d.leaseMutex.Lock()
+	tx, err := d.conn.BeginTx(ctx, nil)
+	if err != nil {
+		d.leaseMutex.Unlock()
+		return fmt.Errorf("database error: %v", err)
+	}
+	_, err = tx.ExecContext(ctx, d.q("UPDATE {group_leases} SET acked = 1 WHERE group_name = ? AND member = ? AND update_id < ? - 1;"), groupName, member, offset)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, d.q("UPDATE {consumer_groups} SET \"offset\" = max(\"offset\", (SELECT coalesce(min(id) + 1, (SELECT coalesce(max(id), 0) + 2 FROM {updates})) FROM {updates} WHERE id >= {consumer_groups}.\"offset\" - 1 AND "+sqlFilterUpdateType+" AND "+sqlFilterOrigin+" AND id NOT IN (SELECT update_id FROM {group_leases} WHERE group_name = @group AND acked))) WHERE name = @group;"),
+			sql.Named("group", groupName), sql.Named("allowed_updates", allowedUpdatesStr), sql.Named("excluded_updates", excludedUpdatesStr), sql.Named("excluded_origins", string(excludedOriginsStr)))
+	}
+	if err == nil {
+		// Leases behind the cursor are no longer needed
+		_, err = tx.ExecContext(ctx, d.q("DELETE FROM {group_leases} WHERE group_name = ?1 AND update_id < (SELECT \"offset\" - 1 FROM {consumer_groups} WHERE name = ?1);"), groupName)
+	}
+	if err != nil {
+		tx.Rollback()
+		d.leaseMutex.Unlock()
+		return fmt.Errorf("database error: %v", err)
+	}
+	err = tx.Commit()
+	d.leaseMutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+// LeaseGroupUpdates hands out up to limit updates to a member of a consumer group, filtered by allowedUpdates and excludedOrigins.
+// An update is skipped if it is confirmed, or leased to a member whose lease hasn't expired yet.
+// The returned updates are leased to this member for visibilityTimeout seconds, after which they are delivered again if not confirmed.
+// Echo updates carry tbmux_origin if showOrigin is true.
+func (d *Database) LeaseGroupUpdates(ctx context.Context, groupName, member string, limit, visibilityTimeout uint64, allowedUpdates, excludedOrigins []string, showOrigin bool) ([]string, error) {
+	allowedUpdatesStr, excludedUpdatesStr, err := marshalUpdateTypeFilter(allowedUpdates)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	excludedOriginsStr, err := json.Marshal(excludedOrigins)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	d.leaseMutex.Lock()
+	conn, err := d.conn.Conn(ctx)
+	if err != nil {
+		d.leaseMutex.Unlock()
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	// Take the write lock before reading, otherwise a write committed by others in between makes the INSERT fail with SQLITE_BUSY right away
+	_, err = conn.ExecContext(ctx, "BEGIN IMMEDIATE;")
+	if err != nil {
+		conn.Close()
+		d.leaseMutex.Unlock()
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	rows, err := conn.QueryContext(ctx, d.q("SELECT id, "+sqlUpdateJSON+" FROM {updates} WHERE id >= (SELECT \"offset\" - 1 FROM {consumer_groups} WHERE name = @group) AND "+sqlFilterUpdateType+" AND "+sqlFilterOrigin+" AND id NOT IN (SELECT update_id FROM {group_leases} WHERE group_name = @group AND (acked OR lease_until > unixepoch())) ORDER BY id ASC LIMIT @limit;"),
+		sql.Named("group", groupName), sql.Named("limit", limit), sql.Named("allowed_updates", allowedUpdatesStr), sql.Named("excluded_updates", excludedUpdatesStr), sql.Named("excluded_origins", string(excludedOriginsStr)), sql.Named("show_origin", showOrigin))
+	if err != nil {
+		conn.ExecContext(context.Background(), "ROLLBACK;")
+		conn.Close()
+		d.leaseMutex.Unlock()
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	var ids []int64
+	var updates []string
+	for rows.Next() {
+		var id int64
+		var update string
+		err = rows.Scan(&id, &update)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+		updates = append(updates, update)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	for _, id := range ids {
+		if err != nil {
+			break
 		}
+		_, err = conn.ExecContext(ctx, d.q("INSERT INTO {group_leases} (group_name, update_id, member, lease_until, delivery_count) VALUES (?1, ?2, ?3, unixepoch() + ?4, 1) ON CONFLICT (group_name, update_id) DO UPDATE SET member = ?3, lease_until = unixepoch() + ?4, delivery_count = delivery_count + 1;"), groupName, id, member, visibilityTimeout)
+	}
+	if err == nil {
+		_, err = conn.ExecContext(ctx, "COMMIT;")
+	}
+	if err != nil {
+		conn.ExecContext(context.Background(), "ROLLBACK;")
+		conn.Close()
+		d.leaseMutex.Unlock()
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	conn.Close()
+	d.leaseMutex.Unlock()
+	return updates, nil
+}
+
+// SkipGroupUpdates moves the shared cursor of a consumer group forward to offset, for example past pruned updates.
+// It returns false if the cursor is already there.
+func (d *Database) SkipGroupUpdates(ctx context.Context, groupName string, offset int64) (bool, error) {
+	d.leaseMutex.Lock()
+	tx, err := d.conn.BeginTx(ctx, nil)
+	if err != nil {
+		d.leaseMutex.Unlock()
+		return false, fmt.Errorf("database error: %v", err)
+	}
+	var moved int64
+	result, err := tx.ExecContext(ctx, d.q("UPDATE {consumer_groups} SET \"offset\" = ?2 WHERE name = ?1 AND \"offset\" < ?2;"), groupName, offset)
+	if err == nil {
+		moved, err = result.RowsAffected()
+	}
+	if err == nil && moved != 0 {
+		_, err = tx.ExecContext(ctx, d.q("DELETE FROM {group_leases} WHERE group_name = ? AND update_id < ? - 1;"), groupName, offset)
+	}
+	if err != nil {
+		tx.Rollback()
+		d.leaseMutex.Unlock()
+		return false, fmt.Errorf("database error: %v", err)
+	}
+	err = tx.Commit()
+	d.leaseMutex.Unlock()
+	if err != nil {
+		return false, fmt.Errorf("database error: %v", err)
+	}
+	return moved != 0, nil
+}
+
+// GetNextLeaseExpiry returns the Unix time when the earliest unconfirmed lease of a consumer group expires, or 0 if there is none.
+func (d *Database) GetNextLeaseExpiry(ctx context.Context, groupName string) (int64, error) {
+	stmt, err := d.conn.PrepareContext(ctx, d.q("SELECT coalesce(min(lease_until), 0) FROM {group_leases} WHERE group_name = ? AND NOT acked;"))
+	if err != nil {
 		return 0, fmt.Errorf("database error: %v", err)
 	}
-	return id, nil
+	var leaseUntil int64
+	err = stmt.QueryRowContext(ctx, groupName).Scan(&leaseUntil)
+	stmt.Close()
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	return leaseUntil, nil
+}
+
+// CountUpdates returns the number of updates starting from offset, filtered by allowedUpdates and excludedOrigins.
+func (d *Database) CountUpdates(ctx context.Context, offset int64, allowedUpdates, excludedOrigins []string) (uint64, error) {
+	allowedUpdatesStr, excludedUpdatesStr, err := marshalUpdateTypeFilter(allowedUpdates)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	excludedOriginsStr, err := json.Marshal(excludedOrigins)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	stmt, err := d.conn.PrepareContext(ctx, d.q("SELECT count(*) FROM {updates} WHERE id >= @offset - 1 AND "+sqlFilterUpdateType+" AND "+sqlFilterOrigin+";"))
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	var count uint64
+	err = stmt.QueryRowContext(ctx, sql.Named("offset", offset), sql.Named("allowed_updates", allowedUpdatesStr), sql.Named("excluded_updates", excludedUpdatesStr), sql.Named("excluded_origins", string(excludedOriginsStr))).Scan(&count)
+	stmt.Close()
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	return count, nil
 }
 
-func (d *Database) GetUpdates(ctx context.Context, offset int64, limit uint64) iter.Seq2[string, error] {
+// GetUpdates returns updates starting from offset, filtered by allowedUpdates.
+// If allowedUpdates is nil, the default types are returned, same as the official API server.
+// Echo updates caused by the clients in excludedOrigins are skipped, and the others carry tbmux_origin if showOrigin is true.
+func (d *Database) GetUpdates(ctx context.Context, offset int64, limit uint64, allowedUpdates, excludedOrigins []string, showOrigin bool) iter.Seq2[string, error] {
 	var stmt *sql.Stmt
 	var err error
 	if offset >= 0 {
-		stmt, err = d.conn.PrepareContext(ctx, "SELECT json_object('update_id', id + 1, type, \"update\") FROM updates WHERE id >= ? - 1 ORDER BY id ASC LIMIT ?;")
+		stmt, err = d.conn.PrepareContext(ctx, d.q("SELECT "+sqlUpdateJSON+" FROM {updates} WHERE id >= @offset - 1 AND "+sqlFilterUpdateType+" AND "+sqlFilterOrigin+" ORDER BY id ASC LIMIT @limit;"))
 	} else {
-		stmt, err = d.conn.PrepareContext(ctx, "SELECT json_object('update_id', id + 1, type, \"update\") FROM (SELECT id, type, \"update\" FROM updates ORDER BY id DESC LIMIT -?) ORDER BY id ASC LIMIT ?;")
+		stmt, err = d.conn.PrepareContext(ctx, d.q("SELECT "+sqlUpdateJSON+" FROM (SELECT id, type, \"update\", origin FROM {updates} WHERE "+sqlFilterUpdateType+" AND "+sqlFilterOrigin+" ORDER BY id DESC LIMIT -@offset) ORDER BY id ASC LIMIT @limit;"))
+	}
+	if err != nil {
+		return func(yield func(string, error) bool) {
+			yield("", fmt.Errorf("database error: %v", err))
+		}
+	}
+	allowedUpdatesStr, excludedUpdatesStr, err := marshalUpdateTypeFilter(allowedUpdates)
+	if err != nil {
+		stmt.Close()
+		return func(yield func(string, error) bool) {
+			yield("", fmt.Errorf("database error: %v", err))
+		}
 	}
+	excludedOriginsStr, err := json.Marshal(excludedOrigins)
 	if err != nil {
+		stmt.Close()
 		return func(yield func(string, error) bool) {
 			yield("", fmt.Errorf("database error: %v", err))
 		}
 	}
-	rows, err := stmt.QueryContext(ctx, offset, limit)
+	rows, err := stmt.QueryContext(ctx, sql.Named("offset", offset), sql.Named("limit", limit), sql.Named("allowed_updates", allowedUpdatesStr), sql.Named("excluded_updates", excludedUpdatesStr), sql.Named("excluded_origins", string(excludedOriginsStr)), sql.Named("show_origin", showOrigin))
 	if err != nil {
 		stmt.Close()
 		return func(yield func(string, error) bool) {
@@ -138,8 +670,32 @@ func (d *Database) GetUpdates(ctx context.Context, offset int64, limit uint64) i
 	}
 }
 
+// sqlUpdateJSON builds an Update object, with tbmux_origin if the update is an echo and @show_origin is true.
+const sqlUpdateJSON = "(CASE WHEN origin IS NULL OR NOT @show_origin THEN json_object('update_id', id + 1, type, \"update\") ELSE json_object('update_id', id + 1, type, \"update\", 'tbmux_origin', json(origin)) END)"
+
+// sqlFilterUpdateType expects @allowed_updates to be the allowed update types, or NULL for all types except @excluded_updates.
+const sqlFilterUpdateType = "(CASE WHEN @allowed_updates IS NULL THEN type NOT IN (SELECT value FROM json_each(@excluded_updates)) ELSE type IN (SELECT value FROM json_each(@allowed_updates)) END)"
+
+// sqlFilterOrigin hides echo updates caused by the clients in @excluded_origins.
+const sqlFilterOrigin = "(origin IS NULL OR json_extract(origin, '$.client') NOT IN (SELECT value FROM json_each(@excluded_origins)))"
+
+func marshalUpdateTypeFilter(allowedUpdates []string) (allowedUpdatesStr sql.NullString, excludedUpdatesStr string, err error) {
+	if len(allowedUpdates) != 0 {
+		buf, err := json.Marshal(allowedUpdates)
+		if err != nil {
+			return sql.NullString{}, "", err
+		}
+		allowedUpdatesStr = sql.NullString{String: string(buf), Valid: true}
+	}
+	buf, err := json.Marshal(slices.Concat(defaultExcludedUpdateTypes, tbmuxUpdateTypes))
+	if err != nil {
+		return sql.NullString{}, "", err
+	}
+	return allowedUpdatesStr, string(buf), nil
+}
+
 func (d *Database) GetChatType(ctx context.Context, chatID int64) (string, error) {
-	stmt, err := d.conn.PrepareContext(ctx, "SELECT json_extract(chat, '$.type') FROM chats WHERE id = ?;")
+	stmt, err := d.conn.PrepareContext(ctx, d.q("SELECT coalesce(json_extract(chat, '$.type'), '') FROM {chats} WHERE id = ?;"))
 	if err != nil {
 		return "", fmt.Errorf("database error: %v", err)
 	}
@@ -155,8 +711,572 @@ func (d *Database) GetChatType(ctx context.Context, chatID int64) (string, error
 	return chatType, nil
 }
 
-func (d *Database) BeginTx() (DatabaseTx, error) {
-	tx := DatabaseTx{
+// GetChatIDByUsername returns the ID of a chat with a public username, or 0 if it is unknown.
+func (d *Database) GetChatIDByUsername(ctx context.Context, username string) (int64, error) {
+	stmt, err := d.conn.PrepareContext(ctx, d.q("SELECT id FROM {chats} WHERE lower(json_extract(chat, '$.username')) = lower(?) ORDER BY id DESC LIMIT 1;"))
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	var chatID int64
+	err = stmt.QueryRowContext(ctx, username).Scan(&chatID)
+	stmt.Close()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	return chatID, nil
+}
+
+// GetChat returns a previously seen chat as JSON, or an empty string if it is unknown.
+func (d *Database) GetChat(ctx context.Context, chatID int64) (string, error) {
+	stmt, err := d.conn.PrepareContext(ctx, d.q("SELECT json(chat) FROM {chats} WHERE id = ?;"))
+	if err != nil {
+		return "", fmt.Errorf("database error: %v", err)
+	}
+	var chat string
+	err = stmt.QueryRowContext(ctx, chatID).Scan(&chat)
+	stmt.Close()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", fmt.Errorf("database error: %v", err)
+	}
+	return chat, nil
+}
+
+// GetMessage returns a stored message as JSON, or an empty string if it is unknown.
+func (d *Database) GetMessage(ctx context.Context, chatID, messageID int64) (string, error) {
+	stmt, err := d.conn.PrepareContext(ctx, d.q("SELECT json(message) FROM {messages} WHERE chat_id = ? AND message_id = ?;"))
+	if err != nil {
+		return "", fmt.Errorf("database error: %v", err)
+	}
+	var message string
+	err = stmt.QueryRowContext(ctx, chatID, messageID).Scan(&message)
+	stmt.Close()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", fmt.Errorf("database error: %v", err)
+	}
+	return message, nil
+}
+
+// Settings keys holding the lowest offset which hasn't missed any pruned update of a type
+const sqlRetentionFloorPrefix = "retention_floor."
+
+// GetRetentionFloor returns the lowest offset which hasn't missed any pruned update of the types in allowedUpdates, or 0 if nothing has been pruned.
+// If allowedUpdates is nil, the default types are checked, same as GetUpdates.
+func (d *Database) GetRetentionFloor(ctx context.Context, allowedUpdates []string) (int64, error) {
+	allowedUpdatesStr, excludedUpdatesStr, err := marshalUpdateTypeFilter(allowedUpdates)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	// Older versions kept a single floor for all types as retention_floor
+	stmt, err := d.conn.PrepareContext(ctx, d.q("SELECT coalesce(max(value), 0) FROM (SELECT value FROM {settings} WHERE key = 'retention_floor' UNION ALL SELECT value FROM (SELECT substr(key, length(@prefix) + 1) AS type, value FROM {settings} WHERE substr(key, 1, length(@prefix)) = @prefix) WHERE "+sqlFilterUpdateType+");"))
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	var floor int64
+	err = stmt.QueryRowContext(ctx, sql.Named("prefix", sqlRetentionFloorPrefix), sql.Named("allowed_updates", allowedUpdatesStr), sql.Named("excluded_updates", excludedUpdatesStr)).Scan(&floor)
+	stmt.Close()
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	return floor, nil
+}
+
+// GetUpstreamOffset returns the upstream offset to confirm on the next getUpdates.
+func (d *Database) GetUpstreamOffset(ctx context.Context) (uint64, error) {
+	offset, err := d.getSettingInt(ctx, "upstream_offset")
+	return uint64(offset), err
+}
+
+// ClearUpstreamOffset forgets the upstream offset once the upstream has confirmed all updates before it.
+func (d *Database) ClearUpstreamOffset(ctx context.Context) error {
+	_, err := d.conn.ExecContext(ctx, d.q("DELETE FROM {settings} WHERE key = 'upstream_offset';"))
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+func (d *Database) getSettingInt(ctx context.Context, key string) (int64, error) {
+	stmt, err := d.conn.PrepareContext(ctx, d.q("SELECT value FROM {settings} WHERE key = ?;"))
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	var value int64
+	err = stmt.QueryRowContext(ctx, key).Scan(&value)
+	stmt.Close()
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	return value, nil
+}
+
+// PruneUpdates deletes updates according to the retention policy, and returns the number of deleted rows.
+// The latest update is always kept, so update_id of new updates keeps increasing.
+func (d *Database) PruneUpdates(ctx context.Context, conf *ConfigRetention, now int64) (int64, error) {
+	tx, err := d.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	const sqlUpdateDate = "coalesce(date, json_extract(\"update\", '$.date'))"
+	var deleted int64
+	// The highest pruned id of each type
+	pruned := make(map[string]int64)
+	prune := func(query string, args ...any) error {
+		rows, err := tx.QueryContext(ctx, d.q(query), args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int64
+			var updateType string
+			err = rows.Scan(&id, &updateType)
+			if err != nil {
+				break
+			}
+			deleted++
+			pruned[updateType] = max(pruned[updateType], id)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+		return err
+	}
+
+	for updateType, maxAge := range conf.MaxAgeByType {
+		if maxAge != 0 {
+			err = prune("DELETE FROM {updates} WHERE type = ? AND "+sqlUpdateDate+" < ? AND id < (SELECT max(id) FROM {updates}) RETURNING id, type;", updateType, now-int64(maxAge))
+			if err != nil {
+				tx.Rollback()
+				return 0, fmt.Errorf("database error: %v", err)
+			}
+		}
+	}
+	if conf.MaxAge != 0 {
+		specialTypes, err := json.Marshal(slices.Collect(maps.Keys(conf.MaxAgeByType)))
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("database error: %v", err)
+		}
+		err = prune("DELETE FROM {updates} WHERE type NOT IN (SELECT value FROM json_each(?)) AND "+sqlUpdateDate+" < ? AND id < (SELECT max(id) FROM {updates}) RETURNING id, type;", string(specialTypes), now-int64(conf.MaxAge))
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("database error: %v", err)
+		}
+	}
+	if conf.MaxUpdates != 0 {
+		err = prune("DELETE FROM {updates} WHERE id < (SELECT id FROM {updates} ORDER BY id DESC LIMIT 1 OFFSET ?) RETURNING id, type;", max(conf.MaxUpdates, 1)-1)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("database error: %v", err)
+		}
+	}
+
+	// Clients polling with an offset not after a pruned update of a type they subscribe to have missed it.
+	// The floor is kept for each type, since a shorter max_age_by_type rule prunes some types while older updates of other types are still retained.
+	for updateType, id := range pruned {
+		_, err = tx.ExecContext(ctx, d.q("INSERT INTO {settings} (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = max(value, excluded.value);"), sqlRetentionFloorPrefix+updateType, id+2)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("database error: %v", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	return deleted, nil
+}
+
+// PruneMessages deletes stored messages according to the retention policy, and returns the number of deleted rows.
+func (d *Database) PruneMessages(ctx context.Context, conf *ConfigRetention, now int64) (int64, error) {
+	var deleted int64
+	if conf.MessageMaxAge != 0 {
+		result, err := d.conn.ExecContext(ctx, d.q("DELETE FROM {messages} WHERE json_extract(message, '$.date') < ?;"), now-int64(conf.MessageMaxAge))
+		if err != nil {
+			return 0, fmt.Errorf("database error: %v", err)
+		}
+		rows, _ := result.RowsAffected()
+		deleted += rows
+	}
+	if conf.MaxMessages != 0 {
+		result, err := d.conn.ExecContext(ctx, d.q("DELETE FROM {messages} WHERE id < (SELECT id FROM {messages} ORDER BY id DESC LIMIT 1 OFFSET ?);"), conf.MaxMessages-1)
+		if err != nil {
+			return 0, fmt.Errorf("database error: %v", err)
+		}
+		rows, _ := result.RowsAffected()
+		deleted += rows
+	}
+	return deleted, nil
+}
+
+// PruneOutbox deletes finished outbox entries, broadcasts, and schedules older than the retention policy.
+func (d *Database) PruneOutbox(ctx context.Context, conf *ConfigRetention, now int64) (int64, error) {
+	if conf.OutboxMaxAge == 0 {
+		return 0, nil
+	}
+	result, err := d.conn.ExecContext(ctx, d.q("DELETE FROM {outbox} WHERE status IN ('sent', 'failed', 'canceled') AND coalesce(sent_date, created_date) < ?;"), now-int64(conf.OutboxMaxAge))
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	rows, _ := result.RowsAffected()
+	_, err = d.conn.ExecContext(ctx, d.q("DELETE FROM {broadcasts} WHERE created_date < ? AND NOT EXISTS (SELECT 1 FROM {outbox} WHERE broadcast_id = {broadcasts}.id);"), now-int64(conf.OutboxMaxAge))
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	_, err = d.conn.ExecContext(ctx, d.q("DELETE FROM {schedules} WHERE status IN ('done', 'canceled') AND send_at < ?;"), now-int64(conf.OutboxMaxAge))
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	return rows, nil
+}
+
+// OutboxEntry is an API call waiting to be sent, or already sent, in the background.
+type OutboxEntry struct {
+	ID          int64
+	BroadcastID int64
+	Client      string
+	Method      string
+	Query       string
+	ContentType string
+	Body        []byte
+	Priority    Priority
+	RequestID   string
+	Status      string
+	CreatedDate int64
+	SentDate    int64
+	HTTPStatus  int
+	Response    string
+}
+
+// InsertOutbox stores a pending API call, and returns its ticket ID.
+func (d *Database) InsertOutbox(ctx context.Context, entry *OutboxEntry) (int64, error) {
+	var id int64
+	err := d.conn.QueryRowContext(ctx, d.q("INSERT INTO {outbox} (client, method, query, content_type, body, priority, request_id, status, created_date) VALUES (?, ?, ?, ?, ?, ?, nullif(?, ''), 'pending', unixepoch()) RETURNING id;"), entry.Client, entry.Method, entry.Query, entry.ContentType, entry.Body, entry.Priority, entry.RequestID).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	return id, nil
+}
+
+// ResetOutbox puts back entries which were being sent when the program stopped.
+func (d *Database) ResetOutbox(ctx context.Context) error {
+	_, err := d.conn.ExecContext(ctx, d.q("UPDATE {outbox} SET status = 'pending' WHERE status = 'sending';"))
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+// TakeOutbox marks the oldest pending entry with the highest priority as being sent, and returns it.
+// It returns nil if there is nothing pending.
+func (d *Database) TakeOutbox(ctx context.Context) (*OutboxEntry, error) {
+	var entry OutboxEntry
+	err := d.conn.QueryRowContext(ctx, d.q("UPDATE {outbox} SET status = 'sending' WHERE id = (SELECT id FROM {outbox} WHERE status = 'pending' ORDER BY priority, id LIMIT 1) RETURNING id, coalesce(broadcast_id, 0), client, method, query, content_type, body, priority, coalesce(request_id, ''), status, created_date;")).Scan(
+		&entry.ID, &entry.BroadcastID, &entry.Client, &entry.Method, &entry.Query, &entry.ContentType, &entry.Body, &entry.Priority, &entry.RequestID, &entry.Status, &entry.CreatedDate,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	return &entry, nil
+}
+
+// FinishOutbox records the response of an entry.
+func (d *Database) FinishOutbox(ctx context.Context, id int64, status string, httpStatus int, response string) error {
+	_, err := d.conn.ExecContext(ctx, d.q("UPDATE {outbox} SET status = ?, sent_date = unixepoch(), http_status = ?, response = ? WHERE id = ?;"), status, httpStatus, response, id)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+// GetOutbox returns an entry submitted by the client, or nil if it doesn't exist.
+func (d *Database) GetOutbox(ctx context.Context, id int64, client string) (*OutboxEntry, error) {
+	var (
+		entry      OutboxEntry
+		sentDate   sql.NullInt64
+		httpStatus sql.NullInt64
+		response   sql.NullString
+	)
+	err := d.conn.QueryRowContext(ctx, d.q("SELECT id, client, method, priority, status, created_date, sent_date, http_status, response FROM {outbox} WHERE id = ? AND client = ?;"), id, client).Scan(
+		&entry.ID, &entry.Client, &entry.Method, &entry.Priority, &entry.Status, &entry.CreatedDate, &sentDate, &httpStatus, &response,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	entry.SentDate = sentDate.Int64
+	entry.HTTPStatus = int(httpStatus.Int64)
+	entry.Response = response.String
+	return &entry, nil
+}
+
+// InsertBroadcast stores the same API call to each selected chat into the outbox.
+// Chats are selected by chatIDs, and by chatTypes from the chats we have seen.
+// It returns the broadcast ID and the number of selected chats.
+func (d *Database) InsertBroadcast(ctx context.Context, client, method, payload string, priority Priority, requestID string, chatIDs []int64, chatTypes []string) (int64, int64, error) {
+	// json_each('null') returns a row of NULL, so never pass nil slices
+	if chatIDs == nil {
+		chatIDs = []int64{}
+	}
+	if chatTypes == nil {
+		chatTypes = []string{}
+	}
+	chatIDsJSON, err := json.Marshal(chatIDs)
+	if err != nil {
+		return 0, 0, fmt.Errorf("database error: %v", err)
+	}
+	chatTypesJSON, err := json.Marshal(chatTypes)
+	if err != nil {
+		return 0, 0, fmt.Errorf("database error: %v", err)
+	}
+	tx, err := d.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("database error: %v", err)
+	}
+	var broadcastID int64
+	err = tx.QueryRowContext(ctx, d.q("INSERT INTO {broadcasts} (client, method, status, created_date) VALUES (?, ?, 'running', unixepoch()) RETURNING id;"), client, method).Scan(&broadcastID)
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, fmt.Errorf("database error: %v", err)
+	}
+	result, err := tx.ExecContext(ctx, d.q(
+		"INSERT INTO {outbox} (client, method, query, content_type, body, priority, request_id, status, created_date, broadcast_id, chat_id) "+
+			"SELECT @client, @method, '', 'application/json', json_set(@payload, '$.chat_id', chat_id), @priority, nullif(@request_id, ''), 'pending', unixepoch(), @broadcast_id, chat_id "+
+			"FROM (SELECT value AS chat_id FROM json_each(@chat_ids) UNION SELECT id FROM {chats} WHERE json_extract(chat, '$.type') IN (SELECT value FROM json_each(@chat_types)));"),
+		sql.Named("client", client), sql.Named("method", method), sql.Named("payload", payload), sql.Named("priority", priority), sql.Named("request_id", requestID),
+		sql.Named("broadcast_id", broadcastID), sql.Named("chat_ids", string(chatIDsJSON)), sql.Named("chat_types", string(chatTypesJSON)),
+	)
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, fmt.Errorf("database error: %v", err)
+	}
+	total, _ := result.RowsAffected()
+	err = tx.Commit()
+	if err != nil {
+		return 0, 0, fmt.Errorf("database error: %v", err)
+	}
+	return broadcastID, total, nil
+}
+
+// Broadcast is the progress of a broadcast.
+type Broadcast struct {
+	ID          int64
+	Method      string
+	Status      string
+	CreatedDate int64
+	Entries     []BroadcastEntry
+}
+
+type BroadcastEntry struct {
+	ChatID     int64
+	Status     string
+	HTTPStatus int
+	Response   string
+}
+
+// GetBroadcast returns a broadcast submitted by the client, or nil if it doesn't exist.
+func (d *Database) GetBroadcast(ctx context.Context, id int64, client string) (*Broadcast, error) {
+	var broadcast Broadcast
+	err := d.conn.QueryRowContext(ctx, d.q("SELECT id, method, status, created_date FROM {broadcasts} WHERE id = ? AND client = ?;"), id, client).Scan(
+		&broadcast.ID, &broadcast.Method, &broadcast.Status, &broadcast.CreatedDate,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	rows, err := d.conn.QueryContext(ctx, d.q("SELECT coalesce(chat_id, 0), status, coalesce(http_status, 0), coalesce(response, '') FROM {outbox} WHERE broadcast_id = ? ORDER BY id;"), id)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	for rows.Next() {
+		var entry BroadcastEntry
+		err = rows.Scan(&entry.ChatID, &entry.Status, &entry.HTTPStatus, &entry.Response)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("database error: %v", err)
+		}
+		broadcast.Entries = append(broadcast.Entries, entry)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	return &broadcast, nil
+}
+
+// CancelBroadcast stops sending a broadcast to the chats still pending.
+// It returns false if the broadcast doesn't exist.
+func (d *Database) CancelBroadcast(ctx context.Context, id int64, client string) (bool, error) {
+	tx, err := d.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("database error: %v", err)
+	}
+	result, err := tx.ExecContext(ctx, d.q("UPDATE {broadcasts} SET status = 'canceled' WHERE id = ? AND client = ?;"), id, client)
+	if err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("database error: %v", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+	_, err = tx.ExecContext(ctx, d.q("UPDATE {outbox} SET status = 'canceled' WHERE broadcast_id = ? AND status = 'pending';"), id)
+	if err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("database error: %v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("database error: %v", err)
+	}
+	return true, nil
+}
+
+// Schedule is an API call to be sent at a specific time, or repeatedly according to a cron expression.
+type Schedule struct {
+	ID           int64
+	Client       string
+	Method       string
+	Body         []byte
+	Priority     Priority
+	RequestID    string
+	SendAt       int64
+	Cron         string
+	Timezone     string
+	Status       string
+	CreatedDate  int64
+	FireCount    int64
+	LastTicketID int64
+}
+
+// InsertSchedule stores a new schedule, and returns its ID.
+func (d *Database) InsertSchedule(ctx context.Context, schedule *Schedule) (int64, error) {
+	var id int64
+	err := d.conn.QueryRowContext(ctx, d.q("INSERT INTO {schedules} (client, method, body, priority, request_id, send_at, cron, timezone, status, created_date) VALUES (?, ?, ?, ?, nullif(?, ''), ?, ?, ?, 'active', unixepoch()) RETURNING id;"),
+		schedule.Client, schedule.Method, schedule.Body, schedule.Priority, schedule.RequestID, schedule.SendAt, schedule.Cron, schedule.Timezone,
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	return id, nil
+}
+
+// GetDueSchedules returns the active schedules whose time has come.
+func (d *Database) GetDueSchedules(ctx context.Context, now int64) ([]*Schedule, error) {
+	rows, err := d.conn.QueryContext(ctx, d.q("SELECT id, client, method, body, priority, coalesce(request_id, ''), send_at, cron, timezone FROM {schedules} WHERE status = 'active' AND send_at <= ? ORDER BY send_at, id;"), now)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	var schedules []*Schedule
+	for rows.Next() {
+		var schedule Schedule
+		err = rows.Scan(&schedule.ID, &schedule.Client, &schedule.Method, &schedule.Body, &schedule.Priority, &schedule.RequestID, &schedule.SendAt, &schedule.Cron, &schedule.Timezone)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("database error: %v", err)
+		}
+		schedules = append(schedules, &schedule)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	return schedules, nil
+}
+
+// GetNextScheduleTime returns when the next active schedule is due, or 0 if there is none.
+func (d *Database) GetNextScheduleTime(ctx context.Context) (int64, error) {
+	var sendAt sql.NullInt64
+	err := d.conn.QueryRowContext(ctx, d.q("SELECT min(send_at) FROM {schedules} WHERE status = 'active';")).Scan(&sendAt)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	return sendAt.Int64, nil
+}
+
+// FireSchedule puts the API call of a schedule into the outbox.
+// The schedule is then due again at nextSendAt, or finished if nextSendAt is 0.
+func (d *Database) FireSchedule(ctx context.Context, schedule *Schedule, nextSendAt int64) (int64, error) {
+	tx, err := d.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	var ticketID int64
+	err = tx.QueryRowContext(ctx, d.q("INSERT INTO {outbox} (client, method, query, content_type, body, priority, request_id, status, created_date) VALUES (?, ?, '', 'application/json', ?, ?, nullif(?, ''), 'pending', unixepoch()) RETURNING id;"),
+		schedule.Client, schedule.Method, schedule.Body, schedule.Priority, schedule.RequestID,
+	).Scan(&ticketID)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	if nextSendAt != 0 {
+		_, err = tx.ExecContext(ctx, d.q("UPDATE {schedules} SET send_at = ?, fire_count = fire_count + 1, last_ticket_id = ? WHERE id = ?;"), nextSendAt, ticketID, schedule.ID)
+	} else {
+		_, err = tx.ExecContext(ctx, d.q("UPDATE {schedules} SET status = 'done', fire_count = fire_count + 1, last_ticket_id = ? WHERE id = ?;"), ticketID, schedule.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	return ticketID, nil
+}
+
+// GetSchedule returns a schedule submitted by the client, or nil if it doesn't exist.
+func (d *Database) GetSchedule(ctx context.Context, id int64, client string) (*Schedule, error) {
+	var (
+		schedule     Schedule
+		lastTicketID sql.NullInt64
+	)
+	err := d.conn.QueryRowContext(ctx, d.q("SELECT id, client, method, priority, send_at, cron, timezone, status, created_date, fire_count, last_ticket_id FROM {schedules} WHERE id = ? AND client = ?;"), id, client).Scan(
+		&schedule.ID, &schedule.Client, &schedule.Method, &schedule.Priority, &schedule.SendAt, &schedule.Cron, &schedule.Timezone, &schedule.Status, &schedule.CreatedDate, &schedule.FireCount, &lastTicketID,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	schedule.LastTicketID = lastTicketID.Int64
+	return &schedule, nil
+}
+
+// CancelSchedule stops an active schedule. It returns false if the schedule doesn't exist or has finished.
+func (d *Database) CancelSchedule(ctx context.Context, id int64, client string) (bool, error) {
+	result, err := d.conn.ExecContext(ctx, d.q("UPDATE {schedules} SET status = 'canceled' WHERE id = ? AND client = ? AND status = 'active';"), id, client)
+	if err != nil {
+		return false, fmt.Errorf("database error: %v", err)
+	}
+	rows, _ := result.RowsAffected()
+	return rows != 0, nil
+}
+
+func (d *Database) BeginTx() (DatabaseTx, error) {
+	tx := DatabaseTx{
 		db:      d,
 		tx:      nil,
 		updated: false,
@@ -166,9 +1286,20 @@ func (d *Database) BeginTx() (DatabaseTx, error) {
 	return tx, err
 }
 
+// The upstream keeps an undelivered update for at most 24 hours, so only updates stored within this number of seconds can be re-delivered.
+// Older upstream update_id values may be reused, for example when the upstream picks a random update_id after a week without updates.
+const upstreamDedupWindow = 86400
+
+// InsertUpdate stores an update from the upstream.
+// A re-delivered update is ignored, so it keeps its original update_id.
+// An older update with the same upstream update_id is not a re-delivery, so it gives up the upstream update_id instead.
 func (tx *DatabaseTx) InsertUpdate(upstreamID uint64, updateType, updateValue string) error {
 	log.Printf("Inserting update %d: {%q:%s}\n", upstreamID, updateType, updateValue)
-	stmt, err := tx.tx.Prepare("INSERT OR REPLACE INTO updates (upstream_id, type, \"update\") VALUES (?, ?, jsonb(?));")
+	_, err := tx.tx.Exec(tx.db.q("UPDATE {updates} SET upstream_id = NULL WHERE upstream_id = ? AND coalesce(date, 0) < unixepoch() - ?;"), upstreamID, upstreamDedupWindow)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	stmt, err := tx.tx.Prepare(tx.db.q("INSERT INTO {updates} (upstream_id, type, \"update\", date) VALUES (?, ?, jsonb(?), unixepoch()) ON CONFLICT (upstream_id) DO NOTHING;"))
 	if err != nil {
 		return fmt.Errorf("database error: %v", err)
 	}
@@ -182,13 +1313,36 @@ func (tx *DatabaseTx) InsertUpdate(upstreamID uint64, updateType, updateValue st
 	return nil
 }
 
-func (tx *DatabaseTx) InsertEchoUpdate(updateType, updateValue string) error {
+// SetUpstreamOffset remembers the upstream offset, so we don't receive the same updates after restarting.
+func (tx *DatabaseTx) SetUpstreamOffset(offset uint64) error {
+	stmt, err := tx.tx.Prepare(tx.db.q("INSERT INTO {settings} (key, value) VALUES ('upstream_offset', ?1) ON CONFLICT (key) DO UPDATE SET value = ?1;"))
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	_, err = stmt.Exec(offset)
+	stmt.Close()
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+// InsertEchoUpdate stores an update generated by telegram-bot-mux for an outgoing API call, together with where the call came from.
+func (tx *DatabaseTx) InsertEchoUpdate(updateType, updateValue string, origin *EchoOrigin) error {
 	log.Printf("Inserting echo update: {%q:%s}\n", updateType, updateValue)
-	stmt, err := tx.tx.Prepare("INSERT OR REPLACE INTO updates (type, \"update\") VALUES (?, jsonb(?));")
+	var originStr sql.NullString
+	if origin != nil {
+		originBuf, err := json.Marshal(origin)
+		if err != nil {
+			return fmt.Errorf("database error: %v", err)
+		}
+		originStr = sql.NullString{String: string(originBuf), Valid: true}
+	}
+	stmt, err := tx.tx.Prepare(tx.db.q("INSERT INTO {updates} (type, \"update\", date, origin) VALUES (?, jsonb(?), unixepoch(), jsonb(?));"))
 	if err != nil {
 		return fmt.Errorf("database error: %v", err)
 	}
-	result, err := stmt.Exec(updateType, updateValue)
+	result, err := stmt.Exec(updateType, updateValue, originStr)
 	if err != nil {
 		stmt.Close()
 		return fmt.Errorf("database error: %v", err)
@@ -204,23 +1358,53 @@ func (tx *DatabaseTx) InsertMessage(messageJSON *gjson.Result) error {
 	chatID := chat.Get("id").Int()
 	log.Println("Inserting message:", messageJSON)
 
-	stmt, err := tx.tx.Prepare("INSERT OR REPLACE INTO chats (id, chat) VALUES (?, jsonb(?));")
+	err := tx.InsertChat(&chat)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.tx.Prepare(tx.db.q("INSERT OR REPLACE INTO {messages} (chat_id, message_id, message) VALUES (?, ?, jsonb(?));"))
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	result, err := stmt.Exec(chatID, messageID, messageJSON.Raw)
+	if err != nil {
+		stmt.Close()
+		return fmt.Errorf("database error: %v", err)
+	}
+	tx.setUpdatedFlag(result)
+	stmt.Close()
+	return nil
+}
+
+// MarkMessagesDeleted records that messages have been deleted from a chat.
+// The messages are kept until they are pruned, so that the deletion can still be looked up.
+func (tx *DatabaseTx) MarkMessagesDeleted(chatID int64, messageIDs []int64) error {
+	messageIDsBuf, err := json.Marshal(messageIDs)
 	if err != nil {
 		return fmt.Errorf("database error: %v", err)
 	}
-	result, err := stmt.Exec(chatID, chat.Raw)
+	stmt, err := tx.tx.Prepare(tx.db.q("UPDATE {messages} SET deleted_date = unixepoch() WHERE chat_id = ? AND message_id IN (SELECT value FROM json_each(?)) AND deleted_date IS NULL;"))
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	result, err := stmt.Exec(chatID, string(messageIDsBuf))
 	if err != nil {
 		stmt.Close()
 		return fmt.Errorf("database error: %v", err)
 	}
 	tx.setUpdatedFlag(result)
 	stmt.Close()
+	return nil
+}
 
-	stmt, err = tx.tx.Prepare("INSERT OR REPLACE INTO messages (chat_id, message_id, message) VALUES (?, ?, jsonb(?));")
+// InsertChat stores or updates the information of a chat.
+func (tx *DatabaseTx) InsertChat(chatJSON *gjson.Result) error {
+	stmt, err := tx.tx.Prepare(tx.db.q("INSERT OR REPLACE INTO {chats} (id, chat) VALUES (?, jsonb(?));"))
 	if err != nil {
 		return fmt.Errorf("database error: %v", err)
 	}
-	result, err = stmt.Exec(chatID, messageID, messageJSON.Raw)
+	result, err := stmt.Exec(chatJSON.Get("id").Int(), chatJSON.Raw)
 	if err != nil {
 		stmt.Close()
 		return fmt.Errorf("database error: %v", err)
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 )
 
@@ -14,12 +15,18 @@ func main() {
 	if err != nil {
 		log.Fatalln(err)
 	}
-	db, err := OpenDatabase(conf)
+	conn, err := OpenDatabase(conf)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	c := NewClient(conf, db)
-	s, err := NewServer(conf, db, c)
+	bots := make([]*Bot, len(conf.Bots))
+	for i, botConf := range conf.Bots {
+		bots[i], err = NewBot(botConf, conn)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	s, err := NewServer(conf, bots)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -31,6 +38,12 @@ func main() {
 		}
 	}()
 
-	err = c.StartPolling(context.Background())
-	log.Fatalln(err)
+	errs := make(chan error)
+	for _, b := range bots {
+		go func() {
+			err := b.c.Start(context.Background())
+			errs <- fmt.Errorf("bot %q: %v", b.conf.Name, err)
+		}()
+	}
+	log.Fatalln(<-errs)
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Number of outbox entries waiting in the rate limiter at the same time
+const outboxConcurrency = 256
+
+// Outbox sends API calls submitted with "X-Tbmux-Async: true" in the background.
+// The calls are stored in the database first, so they survive restarts.
+type Outbox struct {
+	conf     *ConfigBot
+	db       *Database
+	c        *Client
+	wake     chan struct{}
+	sem      chan struct{}
+	mtx      sync.Mutex
+	inflight map[int64]outboxInflight
+}
+
+type outboxInflight struct {
+	broadcastID int64
+	cancel      context.CancelFunc
+}
+
+func NewOutbox(conf *ConfigBot, db *Database, c *Client) *Outbox {
+	return &Outbox{
+		conf:     conf,
+		db:       db,
+		c:        c,
+		wake:     make(chan struct{}, 1),
+		sem:      make(chan struct{}, outboxConcurrency),
+		mtx:      sync.Mutex{},
+		inflight: make(map[int64]outboxInflight),
+	}
+}
+
+// Start resumes the entries left pending before the last shutdown.
+// Entries which were being sent are sent again, since we don't know whether the upstream received them.
+func (o *Outbox) Start(ctx context.Context) error {
+	err := o.db.ResetOutbox(ctx)
+	if err != nil {
+		return err
+	}
+	go o.worker(ctx)
+	return nil
+}
+
+// Notify wakes up the worker after a new entry is stored.
+func (o *Outbox) Notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *Outbox) worker(ctx context.Context) {
+	for {
+		select {
+		case o.sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		entry, err := o.db.TakeOutbox(ctx)
+		if err != nil {
+			<-o.sem
+			if ctx.Err() != nil {
+				return
+			}
+			debug.PrintStack()
+			log.Println("Error:", err)
+			if !sleepContext(ctx, time.Second) {
+				return
+			}
+			continue
+		}
+		if entry == nil {
+			<-o.sem
+			select {
+			case <-o.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		entryCtx, cancel := context.WithCancel(ctx)
+		o.mtx.Lock()
+		o.inflight[entry.ID] = outboxInflight{broadcastID: entry.BroadcastID, cancel: cancel}
+		o.mtx.Unlock()
+		go func() {
+			o.send(ctx, entryCtx, entry)
+			o.mtx.Lock()
+			delete(o.inflight, entry.ID)
+			o.mtx.Unlock()
+			cancel()
+			<-o.sem
+		}()
+	}
+}
+
+// send replays an entry through Client.ForwardRequest, so it goes through the same rate limiting and echo as a synchronous call.
+// Connection errors and flood errors are retried, so an entry is only marked as failed if the upstream rejects it.
+// entryCtx is canceled if the entry is canceled while waiting.
+// It only stops the entry from waiting in the rate limiter, so a call already sent to the upstream is not aborted, and its real result is recorded.
+func (o *Outbox) send(ctx, entryCtx context.Context, entry *OutboxEntry) {
+	retryInterval := time.Second
+	for {
+		w := NewBufferedResponseWriter()
+		err := o.forward(ctx, entryCtx, entry, w)
+		if err == nil && w.code == http.StatusTooManyRequests {
+			// The rate limiter already holds back the chat for retry_after seconds
+			err = fmt.Errorf("upstream server returned error: %d", w.code)
+		} else if err == nil {
+			status := "sent"
+			if w.code < 200 || w.code >= 300 {
+				status = "failed"
+			}
+			o.finish(ctx, entry, status, w.code, w.body.String())
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if entryCtx.Err() != nil {
+			o.finish(ctx, entry, "canceled", 0, "")
+			return
+		}
+		debug.PrintStack()
+		log.Printf("Failed to send outbox entry %d: %v\n", entry.ID, err)
+		if !sleepContext(entryCtx, retryInterval) {
+			if ctx.Err() == nil {
+				o.finish(ctx, entry, "canceled", 0, "")
+			}
+			return
+		}
+		retryInterval = min(retryInterval*2, time.Duration(o.conf.Upstream.MaxRetryInterval)*time.Second)
+	}
+}
+
+// CancelBroadcast stops the entries of a broadcast which are waiting in the rate limiter.
+// Entries still in the database should be canceled through Database.CancelBroadcast first.
+func (o *Outbox) CancelBroadcast(broadcastID int64) {
+	o.mtx.Lock()
+	for _, inflight := range o.inflight {
+		if inflight.broadcastID == broadcastID {
+			inflight.cancel()
+		}
+	}
+	o.mtx.Unlock()
+}
+
+func (o *Outbox) forward(ctx, entryCtx context.Context, entry *OutboxEntry, w http.ResponseWriter) error {
+	requestURL := "/" + entry.Method
+	if len(entry.Query) != 0 {
+		requestURL += "?" + entry.Query
+	}
+	ctx = context.WithValue(ctx, clientContextKey{}, o.client(entry.Client))
+	ctx = context.WithValue(ctx, ticketContextKey{}, entry.ID)
+	ctx = context.WithValue(ctx, waitContextKey{}, entryCtx)
+	r, err := http.NewRequestWithContext(ctx, "POST", requestURL, io.NopCloser(bytes.NewReader(entry.Body)))
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %v", err)
+	}
+	if len(entry.ContentType) != 0 {
+		r.Header.Set("Content-Type", entry.ContentType)
+	}
+	r.Header.Set("X-Tbmux-Priority", entry.Priority.String())
+	if len(entry.RequestID) != 0 {
+		r.Header.Set("X-Tbmux-Request-Id", entry.RequestID)
+	}
+
+	var bodyCopy io.ReadCloser
+	r.Body, bodyCopy = NewPreserveBodyReader(r.Body)
+	return o.c.ForwardRequest(r.Context(), nil, w, r, false, entry.Method, bodyCopy)
+}
+
+type ticketContextKey struct{}
+
+// TicketIDFromContext returns the outbox ticket ID of a request sent by the outbox, or 0 otherwise.
+func TicketIDFromContext(ctx context.Context) int64 {
+	ticketID, _ := ctx.Value(ticketContextKey{}).(int64)
+	return ticketID
+}
+
+type waitContextKey struct{}
+
+// WaitContextFromContext returns the context which stops a request sent by the outbox from waiting in the rate limiter, or ctx itself otherwise.
+func WaitContextFromContext(ctx context.Context) context.Context {
+	if waitCtx, ok := ctx.Value(waitContextKey{}).(context.Context); ok {
+		return waitCtx
+	}
+	return ctx
+}
+
+func (o *Outbox) finish(ctx context.Context, entry *OutboxEntry, status string, httpStatus int, response string) {
+	err := o.db.FinishOutbox(ctx, entry.ID, status, httpStatus, response)
+	if err != nil {
+		debug.PrintStack()
+		log.Println("Error:", err)
+	}
+}
+
+// client returns the configuration of the client who submitted an entry, even if it has been removed since then.
+func (o *Outbox) client(name string) *ConfigClient {
+	if client, ok := o.conf.Downstream.ClientsByName[name]; ok {
+		return client
+	}
+	return &ConfigClient{
+		Name:          name,
+		Priority:      "normal",
+		PriorityValue: PriorityNormal,
+	}
+}
+
+// BufferedResponseWriter keeps the response in memory, for requests not coming from an HTTP connection.
+type BufferedResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func NewBufferedResponseWriter() *BufferedResponseWriter {
+	return &BufferedResponseWriter{
+		header: make(http.Header),
+		code:   http.StatusOK,
+	}
+}
+
+func (w *BufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *BufferedResponseWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+func (w *BufferedResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
@@ -3,26 +3,30 @@ package main
 import (
 	"bytes"
 	"io"
+	"os"
 )
 
+// Request bodies larger than this are spooled to a temporary file instead of memory
+const spoolMemoryLimit = 1 << 20
+
 type PreserveBodyReader struct {
 }
 
 type PreserveBodyReaderMain struct {
 	parent io.ReadCloser
-	buf    *bytes.Buffer
+	buf    *SpoolBuffer
 }
 
 type PreserveBodyReaderCopy struct {
 	parent io.ReadCloser
-	buf    *bytes.Buffer
+	buf    *SpoolBuffer
 }
 
 func NewPreserveBodyReader(parent io.ReadCloser) (io.ReadCloser, io.ReadCloser) {
 	if parent == nil {
 		return nil, nil
 	}
-	buf := new(bytes.Buffer)
+	buf := new(SpoolBuffer)
 	return PreserveBodyReaderMain{parent: parent, buf: buf}, PreserveBodyReaderCopy{parent: parent, buf: buf}
 }
 
@@ -48,8 +52,83 @@ func (r PreserveBodyReaderCopy) Read(p []byte) (n int, err error) {
 }
 
 func (r PreserveBodyReaderCopy) Close() error {
+	r.buf.Close()
 	if r.parent == nil {
 		return nil
 	}
 	return r.parent.Close()
 }
+
+// SpoolBuffer is a FIFO buffer, which keeps the first spoolMemoryLimit bytes in memory, and the rest in a temporary file.
+type SpoolBuffer struct {
+	mem      bytes.Buffer
+	file     *os.File
+	readOff  int64
+	writeOff int64
+	err      error
+}
+
+func (b *SpoolBuffer) Write(p []byte) (n int, err error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.file == nil {
+		if b.mem.Len()+len(p) <= spoolMemoryLimit {
+			return b.mem.Write(p)
+		}
+		b.file, b.err = os.CreateTemp("", "tbmux-spool-")
+		if b.err != nil {
+			return 0, b.err
+		}
+	}
+	n, b.err = b.file.WriteAt(p, b.writeOff)
+	b.writeOff += int64(n)
+	return n, b.err
+}
+
+func (b *SpoolBuffer) Read(p []byte) (n int, err error) {
+	if b.mem.Len() != 0 {
+		return b.mem.Read(p)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.file == nil || b.readOff >= b.writeOff {
+		return 0, io.EOF
+	}
+	n, err = b.file.ReadAt(p[:min(int64(len(p)), b.writeOff-b.readOff)], b.readOff)
+	b.readOff += int64(n)
+	if err == io.EOF && n != 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Len returns the number of unread bytes.
+func (b *SpoolBuffer) Len() int64 {
+	return int64(b.mem.Len()) + b.writeOff - b.readOff
+}
+
+// Replay returns a new reader of the unread bytes without consuming them, so the content can be sent more than once.
+// The reader is only valid until the next Write or Close.
+func (b *SpoolBuffer) Replay() io.Reader {
+	mem := bytes.NewReader(b.mem.Bytes())
+	if b.file == nil {
+		return mem
+	}
+	return io.MultiReader(mem, io.NewSectionReader(b.file, b.readOff, b.writeOff-b.readOff))
+}
+
+// Close releases the temporary file. It is safe to call Close multiple times.
+func (b *SpoolBuffer) Close() error {
+	b.mem.Reset()
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	os.Remove(b.file.Name())
+	b.file = nil
+	b.readOff = 0
+	b.writeOff = 0
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// Pruner periodically deletes old updates, messages, and outbox entries according to the retention policy.
+type Pruner struct {
+	conf *ConfigBot
+	db   *Database
+}
+
+func NewPruner(conf *ConfigBot, db *Database) *Pruner {
+	return &Pruner{
+		conf: conf,
+		db:   db,
+	}
+}
+
+// Start runs the pruner in the background, unless no retention policy is configured.
+func (p *Pruner) Start(ctx context.Context) {
+	retention := &p.conf.Retention
+	hasPolicy := retention.MaxAge != 0 || retention.MaxUpdates != 0 || retention.MessageMaxAge != 0 || retention.MaxMessages != 0 || retention.OutboxMaxAge != 0
+	for _, maxAge := range retention.MaxAgeByType {
+		hasPolicy = hasPolicy || maxAge != 0
+	}
+	if !hasPolicy {
+		return
+	}
+	go func() {
+		for {
+			p.prune(ctx)
+			if !sleepContext(ctx, time.Duration(retention.Interval)*time.Second) {
+				return
+			}
+		}
+	}()
+}
+
+func (p *Pruner) prune(ctx context.Context) {
+	now := time.Now().Unix()
+	updates, err := p.db.PruneUpdates(ctx, &p.conf.Retention, now)
+	if err != nil {
+		debug.PrintStack()
+		log.Println("Failed to prune updates:", err)
+		return
+	}
+	messages, err := p.db.PruneMessages(ctx, &p.conf.Retention, now)
+	if err != nil {
+		debug.PrintStack()
+		log.Println("Failed to prune messages:", err)
+		return
+	}
+	outbox, err := p.db.PruneOutbox(ctx, &p.conf.Retention, now)
+	if err != nil {
+		debug.PrintStack()
+		log.Println("Failed to prune outbox:", err)
+		return
+	}
+	if updates != 0 || messages != 0 || outbox != 0 {
+		log.Printf("Pruned %d updates, %d messages, and %d outbox entries\n", updates, messages, outbox)
+	}
+}
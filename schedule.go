@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// Scheduler moves API calls submitted through .tbmuxSchedule into the outbox when they are due.
+// The outbox then sends them through the same rate limiting and echo as any other call.
+type Scheduler struct {
+	db     *Database
+	outbox *Outbox
+	wake   chan struct{}
+}
+
+func NewScheduler(db *Database, outbox *Outbox) *Scheduler {
+	return &Scheduler{
+		db:     db,
+		outbox: outbox,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+func (s *Scheduler) Start(ctx context.Context) {
+	go s.worker(ctx)
+}
+
+// Notify wakes up the worker after a new schedule is stored, in case it is due earlier than the others.
+func (s *Scheduler) Notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) worker(ctx context.Context) {
+	for {
+		err := s.fireDue(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			debug.PrintStack()
+			log.Println("Error:", err)
+			if !sleepContext(ctx, time.Second) {
+				return
+			}
+			continue
+		}
+
+		nextSendAt, err := s.db.GetNextScheduleTime(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			debug.PrintStack()
+			log.Println("Error:", err)
+			if !sleepContext(ctx, time.Second) {
+				return
+			}
+			continue
+		}
+		// Check again at least once a minute, so that a jump of the system clock doesn't delay schedules for long
+		timer := time.NewTimer(time.Minute)
+		if nextSendAt != 0 {
+			timer.Reset(min(time.Until(time.Unix(nextSendAt, 0)), time.Minute))
+		}
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (s *Scheduler) fireDue(ctx context.Context) error {
+	now := time.Now()
+	schedules, err := s.db.GetDueSchedules(ctx, now.Unix())
+	if err != nil {
+		return err
+	}
+	for _, schedule := range schedules {
+		var nextSendAt int64
+		if len(schedule.Cron) != 0 {
+			// Runs missed while the bot was down are skipped, only the latest one is sent
+			next, err := NextCronTime(schedule.Cron, schedule.Timezone, now)
+			if err != nil {
+				log.Printf("Schedule %d can't be repeated: %v\n", schedule.ID, err)
+			} else if !next.IsZero() {
+				nextSendAt = next.Unix()
+			}
+		}
+		ticketID, err := s.db.FireSchedule(ctx, schedule, nextSendAt)
+		if err != nil {
+			return err
+		}
+		log.Printf("[Schedule] (%s) %s, schedule_id=%d, ticket_id=%d\n", schedule.Client, schedule.Method, schedule.ID, ticketID)
+	}
+	if len(schedules) != 0 {
+		s.outbox.Notify()
+	}
+	return nil
+}
+
+// NextCronTime returns the first time after t matching a cron expression in the specified time zone.
+// It returns the zero time if the expression never matches.
+func NextCronTime(expr, timezone string, t time.Time) (time.Time, error) {
+	c, err := ParseCron(expr)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid cron expression: %v", err)
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time zone: %v", err)
+	}
+	return c.Next(t.In(loc)), nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -16,21 +17,20 @@ import (
 	"time"
 
 	"github.com/gorilla/handlers"
+	"github.com/tidwall/gjson"
 )
 
 type Server struct {
 	conf       *Config
-	db         *Database
-	c          *Client
+	bots       []*Bot
 	httpServer http.Server
 	listener   net.Listener
 }
 
-func NewServer(conf *Config, db *Database, c *Client) (*Server, error) {
+func NewServer(conf *Config, bots []*Bot) (*Server, error) {
 	s := &Server{
 		conf: conf,
-		db:   db,
-		c:    c,
+		bots: bots,
 	}
 	s.httpServer.Handler = handlers.CombinedLoggingHandler(os.Stdout, handlers.CompressHandler(s))
 	var err error
@@ -39,7 +39,11 @@ func NewServer(conf *Config, db *Database, c *Client) (*Server, error) {
 		return nil, fmt.Errorf("failed to start HTTP server: %v", err)
 	}
 	log.Println("HTTP server is listening on", s.listener.Addr())
-	log.Printf("Web console available at http://%s/%s%s/.tbmuxConsole", s.listener.Addr(), strings.TrimPrefix(s.conf.Downstream.ApiPath, "/"), s.conf.Downstream.AuthToken)
+	for _, b := range s.bots {
+		for _, client := range b.conf.Downstream.Clients {
+			log.Printf("Web console for bot %q client %q available at http://%s/%s%s/.tbmuxConsole", b.conf.Name, client.Name, s.listener.Addr(), strings.TrimPrefix(b.conf.Downstream.ApiPath, "/"), client.AuthToken)
+		}
+	}
 	return s, nil
 }
 
@@ -56,73 +60,133 @@ func (s *Server) Serve() error {
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	funcName, code := s.matchPrefix(r, s.c.conf.Downstream.ApiPrefix)
-	if code != http.StatusNotFound {
-		if code != http.StatusOK {
-			s.ReportError(w, code)
-		} else if funcName == "getUpdates" {
-			s.getUpdates(w, r)
+	for _, b := range s.bots {
+		if b.conf.Upstream.Mode == "webhook" && r.URL.Path == b.conf.Upstream.WebhookPath {
+			b.c.HandleWebhook(w, r)
+			return
+		}
+	}
+
+	// Bots may share the same path, so try the next bot if the token doesn't match.
+	unauthorized := false
+	for _, b := range s.bots {
+		funcName, client, code := s.matchPrefix(r, b.conf.Downstream.ApiPrefix, b.conf.Downstream.ClientsByToken)
+		if code == http.StatusUnauthorized {
+			unauthorized = true
+			continue
+		} else if code != http.StatusOK {
+			continue
+		}
+		r = r.WithContext(context.WithValue(r.Context(), clientContextKey{}, client))
+		if funcName == "getUpdates" {
+			s.getUpdates(w, r, b)
 		} else if funcName == "setWebhook" {
-			s.setWebhook(w, r)
+			s.setWebhook(w, r, b)
 		} else if funcName == "deleteWebhook" {
-			s.deleteWebhook(w, r)
+			s.deleteWebhook(w, r, b)
+		} else if funcName == "getWebhookInfo" {
+			s.getWebhookInfo(w, r, b)
 		} else if funcName == ".tbmuxConsole" {
 			s.serveWebConsole(w, r)
+		} else if funcName == ".tbmuxGetQueueStatus" {
+			s.ReportResult(w, b.c.cooldown.Status(), "")
+		} else if funcName == ".tbmuxGetOutboxStatus" {
+			s.getOutboxStatus(w, r, b)
+		} else if funcName == ".tbmuxBroadcast" {
+			s.broadcast(w, r, b)
+		} else if funcName == ".tbmuxGetBroadcastStatus" {
+			s.getBroadcastStatus(w, r, b)
+		} else if funcName == ".tbmuxCancelBroadcast" {
+			s.cancelBroadcast(w, r, b)
+		} else if funcName == ".tbmuxSchedule" {
+			s.schedule(w, r, b)
+		} else if funcName == ".tbmuxGetScheduleStatus" {
+			s.getScheduleStatus(w, r, b)
+		} else if funcName == ".tbmuxCancelSchedule" {
+			s.cancelSchedule(w, r, b)
+		} else if async, _ := strconv.ParseBool(r.Header.Get("X-Tbmux-Async")); async {
+			s.enqueueOutbox(w, r, b, funcName)
 		} else {
-			s.forwardAPI(w, r, funcName)
+			s.forwardAPI(w, r, b, funcName)
 		}
 		return
 	}
-	fileID, code := s.matchPrefix(r, s.c.conf.Downstream.FilePrefix)
-	if code != http.StatusNotFound {
-		if code != http.StatusOK {
-			s.ReportError(w, code)
-		} else {
-			s.forwardFileRequest(w, r, fileID)
+	for _, b := range s.bots {
+		fileID, client, code := s.matchPrefix(r, b.conf.Downstream.FilePrefix, b.conf.Downstream.ClientsByToken)
+		if code == http.StatusUnauthorized {
+			unauthorized = true
+			continue
+		} else if code != http.StatusOK {
+			continue
 		}
+		r = r.WithContext(context.WithValue(r.Context(), clientContextKey{}, client))
+		s.forwardFileRequest(w, r, b, fileID)
+		return
+	}
+	if unauthorized {
+		s.ReportError(w, http.StatusUnauthorized)
 		return
 	}
 	s.ReportError(w, http.StatusNotFound)
 }
 
-func (s *Server) matchPrefix(r *http.Request, prefix []string) (string, int) {
+// matchPrefix checks the request path against prefix, and resolves the authentication token to a client identity.
+func (s *Server) matchPrefix(r *http.Request, prefix []string, clientsByToken map[string]*ConfigClient) (string, *ConfigClient, int) {
 	prefixSegCount := len(prefix)
 	path := strings.SplitN(r.URL.EscapedPath(), "/", prefixSegCount+1)
+	var client *ConfigClient
 	for i := range prefixSegCount {
 		if i >= len(path) {
-			return "", http.StatusNotFound
+			return "", nil, http.StatusNotFound
 		} else if i == prefixSegCount-1 {
 			seg, err := url.PathUnescape(path[i])
 			if err != nil || !strings.HasPrefix(seg, prefix[i]) {
-				return "", http.StatusNotFound
+				return "", nil, http.StatusNotFound
 			}
-			if seg != prefix[i]+s.conf.Downstream.AuthToken {
-				return "", http.StatusUnauthorized
+			var ok bool
+			client, ok = clientsByToken[seg[len(prefix[i]):]]
+			if !ok {
+				return "", nil, http.StatusUnauthorized
 			}
 		} else {
 			seg, err := url.PathUnescape(path[i])
 			if err != nil || seg != prefix[i] {
-				return "", http.StatusNotFound
+				return "", nil, http.StatusNotFound
 			}
 		}
 	}
 	if len(path) != prefixSegCount+1 {
-		return "", http.StatusNotFound
+		return "", nil, http.StatusNotFound
 	}
-	return path[prefixSegCount], http.StatusOK
+	return path[prefixSegCount], client, http.StatusOK
+}
+
+type clientContextKey struct{}
+
+// ClientFromContext returns the downstream client identity who made the request.
+func ClientFromContext(ctx context.Context) *ConfigClient {
+	client, _ := ctx.Value(clientContextKey{}).(*ConfigClient)
+	return client
 }
 
-func (s *Server) getUpdates(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getUpdates(w http.ResponseWriter, r *http.Request, b *Bot) {
 	params := struct {
-		Offset  int64  `json:"offset"`
-		Limit   uint64 `json:"limit"`
-		Timeout uint64 `json:"timeout"`
+		Offset         int64     `json:"offset"`
+		Limit          uint64    `json:"limit"`
+		Timeout        uint64    `json:"timeout"`
+		AllowedUpdates *[]string `json:"allowed_updates"`
 	}{}
 
 	// Fetch request parameters. Ignore errors, just like the official API server
 	params.Offset, _ = strconv.ParseInt(r.FormValue("offset"), 10, 64)
 	params.Limit, _ = strconv.ParseUint(r.FormValue("limit"), 10, 64)
 	params.Timeout, _ = strconv.ParseUint(r.FormValue("timeout"), 10, 64)
+	if allowedUpdatesStr := r.FormValue("allowed_updates"); len(allowedUpdatesStr) != 0 {
+		var allowedUpdates []string
+		if json.Unmarshal([]byte(allowedUpdatesStr), &allowedUpdates) == nil {
+			params.AllowedUpdates = &allowedUpdates
+		}
+	}
 
 	// Alternatively, Telegram Bot API supports submitting request through JSON
 	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
@@ -132,22 +196,59 @@ func (s *Server) getUpdates(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("getUpdates(offset=%d, limit=%d, timeout=%d)\n", params.Offset, params.Limit, params.Timeout)
 
-	// Since we don't delete updates from the database, when 0 <= offset <= 1, we return an empty update for the client to poll again with a new offset value.
-	// Real updates starts from update_id = 2
-	if params.Offset == 0 || params.Offset == 1 {
-		lastUpdateID, err := s.db.GetLastUpdateID(r.Context())
+	client := ClientFromContext(r.Context())
+	consumer, err := b.db.GetConsumer(r.Context(), client.Name)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+
+	if len(consumer.WebhookURL) != 0 {
+		s.ReportErrorDescription(w, http.StatusConflict, "Conflict: can't use getUpdates method while webhook is active; use deleteWebhook to delete the webhook first")
+		return
+	}
+
+	// Just like the official API server, allowed_updates is remembered until it is specified again.
+	if params.AllowedUpdates != nil {
+		err = b.db.SetConsumerAllowedUpdates(r.Context(), client.Name, *params.AllowedUpdates)
 		if err != nil {
 			s.internalServerErrorHandler(w, err)
 			return
 		}
-		h := w.Header()
-		h.Set("Cache-Control", "no-cache")
-		h.Set("Content-Type", "application/json")
-		h.Set("X-Content-Type-Options", "nosniff")
-		fmt.Fprintf(w, "{\"ok\":true,\"result\":[{\"update_id\":%d}]}", lastUpdateID)
+		consumer.AllowedUpdates = *params.AllowedUpdates
+	}
+
+	if client.GroupValue != nil && params.Offset >= 0 {
+		s.getGroupUpdates(w, r, b, client, params.Offset, params.Limit, params.Timeout, params.AllowedUpdates)
 		return
 	}
 
+	// Each client has its own cursor stored in the database.
+	// Just like the official API server, a positive offset confirms all updates before it, and offset = 0 resumes from the first unconfirmed update.
+	// A negative offset returns the last few updates without affecting the cursor, which is useful for the web console.
+	if params.Offset >= 0 {
+		if params.Offset > consumer.Offset {
+			err = b.db.ConfirmUpdates(r.Context(), client.Name, params.Offset)
+			if err != nil {
+				s.internalServerErrorHandler(w, err)
+				return
+			}
+		} else {
+			params.Offset = consumer.Offset
+		}
+
+		// Report an error instead of silently skipping pruned updates
+		floor, err := b.db.GetRetentionFloor(r.Context(), consumer.AllowedUpdates)
+		if err != nil {
+			s.internalServerErrorHandler(w, err)
+			return
+		}
+		if params.Offset < floor {
+			s.ReportErrorDescription(w, http.StatusGone, fmt.Sprintf("Gone: updates before update_id %d have been pruned, use offset=%d or a negative offset to continue", floor, floor))
+			return
+		}
+	}
+
 	// Limit parameter range
 	if params.Limit == 0 || params.Limit > 100 {
 		params.Limit = 100
@@ -155,9 +256,9 @@ func (s *Server) getUpdates(w http.ResponseWriter, r *http.Request) {
 
 	timer := time.After(time.Duration(params.Timeout) * time.Second)
 	for {
-		update, cancel := s.db.SubscribeNextUpdate()
+		update, cancel := b.db.SubscribeNextUpdate()
 		updatesReceived := false
-		for updateJSON, err := range s.db.GetUpdates(r.Context(), params.Offset, params.Limit) {
+		for updateJSON, err := range b.db.GetUpdates(r.Context(), params.Offset, params.Limit, consumer.AllowedUpdates, client.ExcludedOrigins(), client.ShowOrigin) {
 			if err != nil {
 				cancel()
 				if updatesReceived {
@@ -201,17 +302,261 @@ func (s *Server) getUpdates(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) setWebhook(w http.ResponseWriter, _ *http.Request) {
-	s.ReportError(w, http.StatusForbidden)
+// getGroupUpdates serves getUpdates for a member of a consumer group.
+// Members share one cursor, and each update is leased to only one member at a time.
+// A positive offset confirms the updates before it leased to this member, and an update not confirmed within the visibility timeout is leased again.
+func (s *Server) getGroupUpdates(w http.ResponseWriter, r *http.Request, b *Bot, client *ConfigClient, offset int64, limit, timeout uint64, allowedUpdates *[]string) {
+	group, err := b.db.GetConsumerGroup(r.Context(), client.Group)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	// The subscription is shared by all members, since an update can't be skipped by one member and leased to another
+	if allowedUpdates != nil {
+		err = b.db.SetConsumerGroupAllowedUpdates(r.Context(), client.Group, *allowedUpdates)
+		if err != nil {
+			s.internalServerErrorHandler(w, err)
+			return
+		}
+		group.AllowedUpdates = *allowedUpdates
+	}
+	if offset > 0 {
+		err = b.db.ConfirmGroupUpdates(r.Context(), client.Group, client.Name, offset, group.AllowedUpdates, client.ExcludedOrigins())
+		if err != nil {
+			s.internalServerErrorHandler(w, err)
+			return
+		}
+	}
+
+	// Report an error instead of silently skipping pruned updates, same as a single client.
+	// Members can't move the shared cursor past them by themselves, so it is moved here, and the group continues from there on the next call.
+	floor, err := b.db.GetRetentionFloor(r.Context(), group.AllowedUpdates)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	skipped, err := b.db.SkipGroupUpdates(r.Context(), client.Group, floor)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	if skipped {
+		s.ReportErrorDescription(w, http.StatusGone, fmt.Sprintf("Gone: updates before update_id %d have been pruned, call getUpdates again to continue", floor))
+		return
+	}
+
+	// Limit parameter range
+	if limit == 0 || limit > 100 {
+		limit = 100
+	}
+
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	for {
+		update, cancel := b.db.SubscribeNextUpdate()
+		updates, err := b.db.LeaseGroupUpdates(r.Context(), client.Group, client.Name, limit, client.GroupValue.VisibilityTimeout, group.AllowedUpdates, client.ExcludedOrigins(), client.ShowOrigin)
+		if err != nil {
+			cancel()
+			s.internalServerErrorHandler(w, err)
+			return
+		}
+		if len(updates) != 0 || !time.Now().Before(deadline) {
+			cancel()
+			h := w.Header()
+			h.Set("Cache-Control", "no-cache")
+			h.Set("Content-Type", "application/json")
+			h.Set("X-Content-Type-Options", "nosniff")
+			w.Write([]byte("{\"ok\":true,\"result\":["))
+			w.Write([]byte(strings.Join(updates, ",")))
+			w.Write([]byte("]}"))
+			return
+		}
+
+		// Besides new updates, also wake up when a lease of another member expires
+		nextLeaseExpiry, err := b.db.GetNextLeaseExpiry(r.Context(), client.Group)
+		if err != nil {
+			cancel()
+			s.internalServerErrorHandler(w, err)
+			return
+		}
+		timer := time.NewTimer(time.Until(deadline))
+		if nextLeaseExpiry != 0 {
+			timer.Reset(min(time.Until(deadline), time.Until(time.Unix(nextLeaseExpiry, 0))))
+		}
+		select {
+		case <-timer.C:
+			cancel()
+		case <-update:
+			timer.Stop()
+		case <-r.Context().Done():
+			// Don't lease updates to a client who is gone
+			timer.Stop()
+			cancel()
+			return
+		}
+	}
+}
+
+func (s *Server) setWebhook(w http.ResponseWriter, r *http.Request, b *Bot) {
+	params := struct {
+		URL                string    `json:"url"`
+		MaxConnections     uint64    `json:"max_connections"`
+		AllowedUpdates     *[]string `json:"allowed_updates"`
+		DropPendingUpdates bool      `json:"drop_pending_updates"`
+		SecretToken        string    `json:"secret_token"`
+	}{}
+
+	// Fetch request parameters. Ignore errors, just like the official API server
+	params.URL = r.FormValue("url")
+	params.MaxConnections, _ = strconv.ParseUint(r.FormValue("max_connections"), 10, 64)
+	if allowedUpdatesStr := r.FormValue("allowed_updates"); len(allowedUpdatesStr) != 0 {
+		var allowedUpdates []string
+		if json.Unmarshal([]byte(allowedUpdatesStr), &allowedUpdates) == nil {
+			params.AllowedUpdates = &allowedUpdates
+		}
+	}
+	params.DropPendingUpdates, _ = strconv.ParseBool(r.FormValue("drop_pending_updates"))
+	params.SecretToken = r.FormValue("secret_token")
+
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "application/json" {
+		_ = json.NewDecoder(io.LimitReader(r.Body, httpBodyLimit)).Decode(&params)
+	}
+
+	if params.MaxConnections == 0 {
+		params.MaxConnections = 40
+	} else if params.MaxConnections > 100 {
+		params.MaxConnections = 100
+	}
+	if len(params.URL) != 0 {
+		webhookURL, err := url.Parse(params.URL)
+		if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || len(webhookURL.Host) == 0 {
+			s.ReportErrorDescription(w, http.StatusBadRequest, "Bad Request: bad webhook: invalid webhook URL specified")
+			return
+		}
+	}
+	if len(params.SecretToken) > 256 || strings.ContainsFunc(params.SecretToken, func(r rune) bool {
+		return !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-')
+	}) {
+		s.ReportErrorDescription(w, http.StatusBadRequest, "Bad Request: secret token contains unallowed characters")
+		return
+	}
+
+	client := ClientFromContext(r.Context())
+	if client.GroupValue != nil && len(params.URL) != 0 {
+		s.ReportErrorDescription(w, http.StatusBadRequest, "Bad Request: webhooks can't be used by members of a consumer group, use getUpdates instead")
+		return
+	}
+	_, err := b.db.GetConsumer(r.Context(), client.Name)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	if params.AllowedUpdates != nil {
+		err = b.db.SetConsumerAllowedUpdates(r.Context(), client.Name, *params.AllowedUpdates)
+		if err != nil {
+			s.internalServerErrorHandler(w, err)
+			return
+		}
+	}
+	if params.DropPendingUpdates {
+		err = b.db.DropPendingUpdates(r.Context(), client.Name)
+		if err != nil {
+			s.internalServerErrorHandler(w, err)
+			return
+		}
+	}
+	err = b.db.SetConsumerWebhook(r.Context(), client.Name, params.URL, params.SecretToken, params.MaxConnections)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	b.webhooks.Restart(client.Name)
+
+	if len(params.URL) == 0 {
+		s.ReportResult(w, true, "Webhook was deleted")
+	} else {
+		s.ReportResult(w, true, "Webhook was set")
+	}
 }
 
-func (s *Server) deleteWebhook(w http.ResponseWriter, _ *http.Request) {
-	// Prevent the parameter drop_pending_updates from being passed to the upstream
-	h := w.Header()
-	h.Set("Cache-Control", "no-cache")
-	h.Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("{\"ok\":true,\"result\":true,\"description\":\"Webhook is already deleted\"}"))
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request, b *Bot) {
+	// drop_pending_updates only moves the cursor of this client, the upstream is never called
+	dropPendingUpdates, _ := strconv.ParseBool(r.FormValue("drop_pending_updates"))
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "application/json" {
+		params := struct {
+			DropPendingUpdates bool `json:"drop_pending_updates"`
+		}{}
+		_ = json.NewDecoder(io.LimitReader(r.Body, httpBodyLimit)).Decode(&params)
+		dropPendingUpdates = params.DropPendingUpdates
+	}
+
+	client := ClientFromContext(r.Context())
+	consumer, err := b.db.GetConsumer(r.Context(), client.Name)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	if dropPendingUpdates {
+		err = b.db.DropPendingUpdates(r.Context(), client.Name)
+		if err != nil {
+			s.internalServerErrorHandler(w, err)
+			return
+		}
+	}
+	if len(consumer.WebhookURL) == 0 {
+		s.ReportResult(w, true, "Webhook is already deleted")
+		return
+	}
+	err = b.db.SetConsumerWebhook(r.Context(), client.Name, "", "", 0)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	b.webhooks.Restart(client.Name)
+	s.ReportResult(w, true, "Webhook was deleted")
+}
+
+func (s *Server) getWebhookInfo(w http.ResponseWriter, r *http.Request, b *Bot) {
+	client := ClientFromContext(r.Context())
+	consumer, err := b.db.GetConsumer(r.Context(), client.Name)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	offset, allowedUpdates := consumer.Offset, consumer.AllowedUpdates
+	if client.GroupValue != nil {
+		// Members of a consumer group report the pending updates of the whole group, including those leased to other members
+		group, err := b.db.GetConsumerGroup(r.Context(), client.Group)
+		if err != nil {
+			s.internalServerErrorHandler(w, err)
+			return
+		}
+		offset, allowedUpdates = group.Offset, group.AllowedUpdates
+	}
+	pendingUpdateCount, err := b.db.CountUpdates(r.Context(), offset, allowedUpdates, client.ExcludedOrigins())
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+
+	s.ReportResult(w, struct {
+		URL                  string   `json:"url"`
+		HasCustomCertificate bool     `json:"has_custom_certificate"`
+		PendingUpdateCount   uint64   `json:"pending_update_count"`
+		LastErrorDate        int64    `json:"last_error_date,omitempty"`
+		LastErrorMessage     string   `json:"last_error_message,omitempty"`
+		MaxConnections       uint64   `json:"max_connections,omitempty"`
+		AllowedUpdates       []string `json:"allowed_updates,omitempty"`
+	}{
+		URL:                  consumer.WebhookURL,
+		HasCustomCertificate: false,
+		PendingUpdateCount:   pendingUpdateCount,
+		LastErrorDate:        consumer.WebhookLastErrorDate,
+		LastErrorMessage:     consumer.WebhookLastErrorMessage,
+		MaxConnections:       consumer.WebhookMaxConnections,
+		AllowedUpdates:       consumer.AllowedUpdates,
+	}, "")
 }
 
 func (s *Server) serveWebConsole(w http.ResponseWriter, _ *http.Request) {
@@ -224,24 +569,419 @@ func (s *Server) serveWebConsole(w http.ResponseWriter, _ *http.Request) {
 	w.Write(webConsoleBody)
 }
 
-func (s *Server) forwardAPI(w http.ResponseWriter, r *http.Request, funcName string) {
+func (s *Server) forwardAPI(w http.ResponseWriter, r *http.Request, b *Bot, funcName string) {
 	var bodyCopy io.ReadCloser
 	r.Body, bodyCopy = NewPreserveBodyReader(r.Body)
 
-	err := s.c.ForwardRequest(r.Context(), s, w, r, false, funcName, bodyCopy)
+	err := b.c.ForwardRequest(r.Context(), s, w, r, false, funcName, bodyCopy)
 	if err != nil {
 		s.internalServerErrorHandler(w, err)
 	}
 }
 
-func (s *Server) forwardFileRequest(w http.ResponseWriter, r *http.Request, fileID string) {
-	err := s.c.ForwardRequest(r.Context(), s, w, r, true, fileID, r.Body)
+// enqueueOutbox stores an API call in the outbox, and returns a ticket ID without waiting for the upstream.
+func (s *Server) enqueueOutbox(w http.ResponseWriter, r *http.Request, b *Bot, funcName string) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, httpBodyLimit+1))
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	if len(body) > httpBodyLimit {
+		s.ReportError(w, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	client := ClientFromContext(r.Context())
+	priority := client.PriorityValue
+	if value, ok := ParsePriority(r.Header.Get("X-Tbmux-Priority")); ok {
+		priority = value
+	}
+	ticketID, err := b.db.InsertOutbox(r.Context(), &OutboxEntry{
+		Client:      client.Name,
+		Method:      funcName,
+		Query:       r.URL.RawQuery,
+		ContentType: r.Header.Get("Content-Type"),
+		Body:        body,
+		Priority:    priority,
+		RequestID:   r.Header.Get("X-Tbmux-Request-Id"),
+	})
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	b.outbox.Notify()
+	log.Printf("[Outbox] (%s) %s, ticket_id=%d\n", client.Name, funcName, ticketID)
+
+	s.ReportResult(w, struct {
+		TicketID int64 `json:"ticket_id"`
+	}{
+		TicketID: ticketID,
+	}, "")
+}
+
+func (s *Server) getOutboxStatus(w http.ResponseWriter, r *http.Request, b *Bot) {
+	params := struct {
+		TicketID int64 `json:"ticket_id"`
+	}{}
+	params.TicketID, _ = strconv.ParseInt(r.FormValue("ticket_id"), 10, 64)
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "application/json" {
+		_ = json.NewDecoder(io.LimitReader(r.Body, httpBodyLimit)).Decode(&params)
+	}
+
+	client := ClientFromContext(r.Context())
+	entry, err := b.db.GetOutbox(r.Context(), params.TicketID, client.Name)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	if entry == nil {
+		s.ReportErrorDescription(w, http.StatusBadRequest, "Bad Request: ticket not found")
+		return
+	}
+
+	var response json.RawMessage
+	if json.Valid([]byte(entry.Response)) {
+		response = json.RawMessage(entry.Response)
+	}
+	s.ReportResult(w, struct {
+		TicketID    int64           `json:"ticket_id"`
+		Method      string          `json:"method"`
+		Priority    string          `json:"priority"`
+		Status      string          `json:"status"`
+		CreatedDate int64           `json:"created_date"`
+		SentDate    int64           `json:"sent_date,omitempty"`
+		HTTPStatus  int             `json:"http_status,omitempty"`
+		Response    json.RawMessage `json:"response,omitempty"`
+	}{
+		TicketID:    entry.ID,
+		Method:      entry.Method,
+		Priority:    entry.Priority.String(),
+		Status:      entry.Status,
+		CreatedDate: entry.CreatedDate,
+		SentDate:    entry.SentDate,
+		HTTPStatus:  entry.HTTPStatus,
+		Response:    response,
+	}, "")
+}
+
+// broadcast sends the same API call to many chats through the outbox.
+func (s *Server) broadcast(w http.ResponseWriter, r *http.Request, b *Bot) {
+	params := struct {
+		Method    string          `json:"method"`
+		Payload   json.RawMessage `json:"payload"`
+		ChatIDs   []int64         `json:"chat_ids"`
+		ChatTypes []string        `json:"chat_types"`
+	}{}
+	params.Method = r.FormValue("method")
+	params.Payload = json.RawMessage(r.FormValue("payload"))
+	_ = json.Unmarshal([]byte(r.FormValue("chat_ids")), &params.ChatIDs)
+	_ = json.Unmarshal([]byte(r.FormValue("chat_types")), &params.ChatTypes)
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "application/json" {
+		_ = json.NewDecoder(io.LimitReader(r.Body, httpBodyLimit)).Decode(&params)
+	}
+
+	if len(params.Method) == 0 {
+		params.Method = "sendMessage"
+	}
+	if _, ok := b.c.echoUpdateType[params.Method]; !ok {
+		s.ReportErrorDescription(w, http.StatusBadRequest, "Bad Request: method can't be broadcast")
+		return
+	}
+	if !gjson.ValidBytes(params.Payload) || !gjson.ParseBytes(params.Payload).IsObject() {
+		s.ReportErrorDescription(w, http.StatusBadRequest, "Bad Request: payload must be a JSON object")
+		return
+	}
+	if len(params.ChatIDs) == 0 && len(params.ChatTypes) == 0 {
+		s.ReportErrorDescription(w, http.StatusBadRequest, "Bad Request: chat_ids or chat_types must be specified")
+		return
+	}
+
+	// Broadcasts are low priority by default, so that they don't delay interactive replies
+	client := ClientFromContext(r.Context())
+	priority := PriorityLow
+	if value, ok := ParsePriority(r.Header.Get("X-Tbmux-Priority")); ok {
+		priority = value
+	}
+	broadcastID, total, err := b.db.InsertBroadcast(r.Context(), client.Name, params.Method, string(params.Payload), priority, r.Header.Get("X-Tbmux-Request-Id"), params.ChatIDs, params.ChatTypes)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	b.outbox.Notify()
+	log.Printf("[Broadcast] (%s) %s to %d chats, broadcast_id=%d\n", client.Name, params.Method, total, broadcastID)
+
+	s.ReportResult(w, struct {
+		BroadcastID int64 `json:"broadcast_id"`
+		Total       int64 `json:"total"`
+	}{
+		BroadcastID: broadcastID,
+		Total:       total,
+	}, "")
+}
+
+func (s *Server) getBroadcastStatus(w http.ResponseWriter, r *http.Request, b *Bot) {
+	broadcastID := s.int64Param(r, "broadcast_id")
+	client := ClientFromContext(r.Context())
+	broadcast, err := b.db.GetBroadcast(r.Context(), broadcastID, client.Name)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	if broadcast == nil {
+		s.ReportErrorDescription(w, http.StatusBadRequest, "Bad Request: broadcast not found")
+		return
+	}
+
+	type broadcastError struct {
+		ChatID          int64  `json:"chat_id"`
+		ErrorCode       int64  `json:"error_code"`
+		Description     string `json:"description,omitempty"`
+		MigrateToChatID int64  `json:"migrate_to_chat_id,omitempty"`
+	}
+	result := struct {
+		BroadcastID int64            `json:"broadcast_id"`
+		Method      string           `json:"method"`
+		Status      string           `json:"status"`
+		CreatedDate int64            `json:"created_date"`
+		Total       int              `json:"total"`
+		Pending     int              `json:"pending"`
+		Sent        int              `json:"sent"`
+		Blocked     int              `json:"blocked"`
+		Migrated    int              `json:"migrated"`
+		Failed      int              `json:"failed"`
+		Canceled    int              `json:"canceled"`
+		Errors      []broadcastError `json:"errors"`
+	}{
+		BroadcastID: broadcast.ID,
+		Method:      broadcast.Method,
+		Status:      broadcast.Status,
+		CreatedDate: broadcast.CreatedDate,
+		Total:       len(broadcast.Entries),
+		Errors:      []broadcastError{},
+	}
+	for _, entry := range broadcast.Entries {
+		switch entry.Status {
+		case "pending", "sending":
+			result.Pending++
+		case "sent":
+			result.Sent++
+		case "canceled":
+			result.Canceled++
+		default:
+			response := gjson.Parse(entry.Response)
+			e := broadcastError{
+				ChatID:          entry.ChatID,
+				ErrorCode:       response.Get("error_code").Int(),
+				Description:     response.Get("description").String(),
+				MigrateToChatID: response.Get("parameters.migrate_to_chat_id").Int(),
+			}
+			if e.ErrorCode == 0 {
+				e.ErrorCode = int64(entry.HTTPStatus)
+			}
+			if e.MigrateToChatID != 0 {
+				result.Migrated++
+			} else if e.ErrorCode == http.StatusForbidden {
+				result.Blocked++
+			} else {
+				result.Failed++
+			}
+			result.Errors = append(result.Errors, e)
+		}
+	}
+	if result.Status == "running" && result.Pending == 0 {
+		result.Status = "done"
+	}
+	s.ReportResult(w, result, "")
+}
+
+func (s *Server) cancelBroadcast(w http.ResponseWriter, r *http.Request, b *Bot) {
+	broadcastID := s.int64Param(r, "broadcast_id")
+	client := ClientFromContext(r.Context())
+	found, err := b.db.CancelBroadcast(r.Context(), broadcastID, client.Name)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	if !found {
+		s.ReportErrorDescription(w, http.StatusBadRequest, "Bad Request: broadcast not found")
+		return
+	}
+	b.outbox.CancelBroadcast(broadcastID)
+	log.Printf("[Broadcast] (%s) canceled broadcast_id=%d\n", client.Name, broadcastID)
+	s.ReportResult(w, true, "")
+}
+
+// schedule stores an API call to be sent through the outbox at send_at, or repeatedly according to cron.
+func (s *Server) schedule(w http.ResponseWriter, r *http.Request, b *Bot) {
+	params := struct {
+		Method   string          `json:"method"`
+		Payload  json.RawMessage `json:"payload"`
+		SendAt   int64           `json:"send_at"`
+		Cron     string          `json:"cron"`
+		Timezone string          `json:"timezone"`
+	}{}
+	params.Method = r.FormValue("method")
+	params.Payload = json.RawMessage(r.FormValue("payload"))
+	params.SendAt, _ = strconv.ParseInt(r.FormValue("send_at"), 10, 64)
+	params.Cron = r.FormValue("cron")
+	params.Timezone = r.FormValue("timezone")
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "application/json" {
+		_ = json.NewDecoder(io.LimitReader(r.Body, httpBodyLimit)).Decode(&params)
+	}
+
+	switch {
+	case len(params.Method) == 0:
+		s.ReportErrorDescription(w, http.StatusBadRequest, "Bad Request: method must be specified")
+		return
+	case strings.HasPrefix(params.Method, "."), params.Method == "getUpdates", params.Method == "setWebhook", params.Method == "deleteWebhook", params.Method == "getWebhookInfo":
+		s.ReportErrorDescription(w, http.StatusBadRequest, "Bad Request: method can't be scheduled")
+		return
+	}
+	if len(params.Payload) == 0 {
+		params.Payload = json.RawMessage("{}")
+	}
+	if !gjson.ValidBytes(params.Payload) || !gjson.ParseBytes(params.Payload).IsObject() {
+		s.ReportErrorDescription(w, http.StatusBadRequest, "Bad Request: payload must be a JSON object")
+		return
+	}
+	if len(params.Timezone) == 0 {
+		params.Timezone = "UTC"
+	}
+	if len(params.Cron) != 0 {
+		if params.SendAt != 0 {
+			s.ReportErrorDescription(w, http.StatusBadRequest, "Bad Request: send_at and cron can't be both specified")
+			return
+		}
+		next, err := NextCronTime(params.Cron, params.Timezone, time.Now())
+		if err != nil {
+			s.ReportErrorDescription(w, http.StatusBadRequest, fmt.Sprintf("Bad Request: %v", err))
+			return
+		}
+		if next.IsZero() {
+			s.ReportErrorDescription(w, http.StatusBadRequest, "Bad Request: cron expression never matches")
+			return
+		}
+		params.SendAt = next.Unix()
+	} else if params.SendAt == 0 {
+		s.ReportErrorDescription(w, http.StatusBadRequest, "Bad Request: send_at or cron must be specified")
+		return
+	}
+
+	client := ClientFromContext(r.Context())
+	priority := client.PriorityValue
+	if value, ok := ParsePriority(r.Header.Get("X-Tbmux-Priority")); ok {
+		priority = value
+	}
+	scheduleID, err := b.db.InsertSchedule(r.Context(), &Schedule{
+		Client:    client.Name,
+		Method:    params.Method,
+		Body:      params.Payload,
+		Priority:  priority,
+		RequestID: r.Header.Get("X-Tbmux-Request-Id"),
+		SendAt:    params.SendAt,
+		Cron:      params.Cron,
+		Timezone:  params.Timezone,
+	})
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	b.schedule.Notify()
+	log.Printf("[Schedule] (%s) %s at %d, schedule_id=%d\n", client.Name, params.Method, params.SendAt, scheduleID)
+
+	s.ReportResult(w, struct {
+		ScheduleID int64 `json:"schedule_id"`
+		SendAt     int64 `json:"send_at"`
+	}{
+		ScheduleID: scheduleID,
+		SendAt:     params.SendAt,
+	}, "")
+}
+
+func (s *Server) getScheduleStatus(w http.ResponseWriter, r *http.Request, b *Bot) {
+	scheduleID := s.int64Param(r, "schedule_id")
+	client := ClientFromContext(r.Context())
+	schedule, err := b.db.GetSchedule(r.Context(), scheduleID, client.Name)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	if schedule == nil {
+		s.ReportErrorDescription(w, http.StatusBadRequest, "Bad Request: schedule not found")
+		return
+	}
+
+	result := struct {
+		ScheduleID   int64  `json:"schedule_id"`
+		Method       string `json:"method"`
+		Priority     string `json:"priority"`
+		Status       string `json:"status"`
+		CreatedDate  int64  `json:"created_date"`
+		SendAt       int64  `json:"send_at"`
+		Cron         string `json:"cron,omitempty"`
+		Timezone     string `json:"timezone,omitempty"`
+		FireCount    int64  `json:"fire_count"`
+		LastTicketID int64  `json:"last_ticket_id,omitempty"`
+	}{
+		ScheduleID:   schedule.ID,
+		Method:       schedule.Method,
+		Priority:     schedule.Priority.String(),
+		Status:       schedule.Status,
+		CreatedDate:  schedule.CreatedDate,
+		SendAt:       schedule.SendAt,
+		Cron:         schedule.Cron,
+		FireCount:    schedule.FireCount,
+		LastTicketID: schedule.LastTicketID,
+	}
+	if len(schedule.Cron) != 0 {
+		result.Timezone = schedule.Timezone
+	}
+	s.ReportResult(w, result, "")
+}
+
+func (s *Server) cancelSchedule(w http.ResponseWriter, r *http.Request, b *Bot) {
+	scheduleID := s.int64Param(r, "schedule_id")
+	client := ClientFromContext(r.Context())
+	found, err := b.db.CancelSchedule(r.Context(), scheduleID, client.Name)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	if !found {
+		s.ReportErrorDescription(w, http.StatusBadRequest, "Bad Request: schedule not found")
+		return
+	}
+	log.Printf("[Schedule] (%s) canceled schedule_id=%d\n", client.Name, scheduleID)
+	s.ReportResult(w, true, "")
+}
+
+// int64Param reads an integer parameter from either the form or the JSON body.
+func (s *Server) int64Param(r *http.Request, name string) int64 {
+	value, _ := strconv.ParseInt(r.FormValue(name), 10, 64)
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "application/json" {
+		var params map[string]json.RawMessage
+		_ = json.NewDecoder(io.LimitReader(r.Body, httpBodyLimit)).Decode(&params)
+		_ = json.Unmarshal(params[name], &value)
+	}
+	return value
+}
+
+func (s *Server) forwardFileRequest(w http.ResponseWriter, r *http.Request, b *Bot, fileID string) {
+	err := b.c.ForwardRequest(r.Context(), s, w, r, true, fileID, r.Body)
 	if err != nil {
 		s.internalServerErrorHandler(w, err)
 	}
 }
 
 func (s *Server) ReportError(w http.ResponseWriter, code int) {
+	s.ReportErrorDescription(w, code, http.StatusText(code))
+}
+
+func (s *Server) ReportErrorDescription(w http.ResponseWriter, code int, description string) {
 	body, err := json.Marshal(struct {
 		OK          bool   `json:"ok"`
 		ErrorCode   int    `json:"error_code"`
@@ -249,7 +989,7 @@ func (s *Server) ReportError(w http.ResponseWriter, code int) {
 	}{
 		OK:          false,
 		ErrorCode:   code,
-		Description: http.StatusText(code),
+		Description: description,
 	})
 	if err != nil {
 		panic(err)
@@ -264,6 +1004,29 @@ func (s *Server) ReportError(w http.ResponseWriter, code int) {
 	w.Write(body)
 }
 
+func (s *Server) ReportResult(w http.ResponseWriter, result any, description string) {
+	body, err := json.Marshal(struct {
+		OK          bool   `json:"ok"`
+		Result      any    `json:"result"`
+		Description string `json:"description,omitempty"`
+	}{
+		OK:          true,
+		Result:      result,
+		Description: description,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	h := w.Header()
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
 func (s *Server) internalServerErrorHandler(w http.ResponseWriter, err error) {
 	debug.PrintStack()
 	log.Println("Error:", err)
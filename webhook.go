@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	webhookTimeout          = 60 * time.Second
+	webhookMaxRetryInterval = 10 * time.Minute
+)
+
+// WebhookDispatcher pushes updates to downstream clients who registered a webhook through setWebhook.
+type WebhookDispatcher struct {
+	conf    *ConfigBot
+	db      *Database
+	mtx     sync.Mutex
+	workers map[string]context.CancelFunc
+}
+
+func NewWebhookDispatcher(conf *ConfigBot, db *Database) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		conf:    conf,
+		db:      db,
+		mtx:     sync.Mutex{},
+		workers: make(map[string]context.CancelFunc),
+	}
+}
+
+// Start resumes deliveries for webhooks registered before the last shutdown.
+// Webhooks of clients which are no longer in the config are cleared.
+func (d *WebhookDispatcher) Start(ctx context.Context) error {
+	names, err := d.db.GetWebhookConsumers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, ok := d.conf.Downstream.ClientsByName[name]; !ok {
+			// The client has been removed from the config, so it shouldn't receive any more updates
+			log.Printf("Removing the webhook of client %q, which is no longer configured\n", name)
+			err = d.db.SetConsumerWebhook(ctx, name, "", "", 0)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		d.Restart(name)
+	}
+	return nil
+}
+
+// Restart stops the delivery worker of a client, and starts a new one with its latest webhook settings.
+func (d *WebhookDispatcher) Restart(name string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.mtx.Lock()
+	if cancelOld, ok := d.workers[name]; ok {
+		cancelOld()
+	}
+	d.workers[name] = cancel
+	d.mtx.Unlock()
+	go d.worker(ctx, name)
+}
+
+func (d *WebhookDispatcher) worker(ctx context.Context, name string) {
+	client := d.conf.Downstream.ClientsByName[name]
+	retryInterval := time.Second
+	for {
+		notify, cancel := d.db.SubscribeNextUpdate()
+		consumer, err := d.db.GetConsumer(ctx, name)
+		if err != nil {
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			debug.PrintStack()
+			log.Println("Error:", err)
+			if !sleepContext(ctx, retryInterval) {
+				return
+			}
+			retryInterval = min(retryInterval*2, webhookMaxRetryInterval)
+			continue
+		}
+		if len(consumer.WebhookURL) == 0 {
+			cancel()
+			return
+		}
+		floor, err := d.db.GetRetentionFloor(ctx, consumer.AllowedUpdates)
+		if err == nil && consumer.Offset < floor {
+			// Pruned updates can't be delivered, so skip them and let the client know through getWebhookInfo
+			log.Printf("Updates before update_id %d have been pruned before delivering to client %q\n", floor, name)
+			err = d.db.SetConsumerWebhookError(ctx, name, time.Now().Unix(), fmt.Sprintf("updates before update_id %d have been pruned", floor))
+			if err == nil {
+				err = d.db.ConfirmUpdates(ctx, name, floor)
+			}
+			consumer.Offset = floor
+		}
+		if err != nil {
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			debug.PrintStack()
+			log.Println("Error:", err)
+			if !sleepContext(ctx, retryInterval) {
+				return
+			}
+			retryInterval = min(retryInterval*2, webhookMaxRetryInterval)
+			continue
+		}
+
+		// Updates are delivered in batches of max_connections, and the cursor only moves after the whole batch is accepted.
+		var batch []string
+		for updateJSON, iterErr := range d.db.GetUpdates(ctx, consumer.Offset, max(consumer.WebhookMaxConnections, 1), consumer.AllowedUpdates, client.ExcludedOrigins(), client.ShowOrigin) {
+			if iterErr != nil {
+				err = iterErr
+				break
+			}
+			batch = append(batch, updateJSON)
+		}
+		if err != nil {
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			debug.PrintStack()
+			log.Println("Error:", err)
+			if !sleepContext(ctx, retryInterval) {
+				return
+			}
+			retryInterval = min(retryInterval*2, webhookMaxRetryInterval)
+			continue
+		}
+		if len(batch) == 0 {
+			select {
+			case <-notify:
+				continue
+			case <-ctx.Done():
+				cancel()
+				return
+			}
+		}
+		cancel()
+
+		lastUpdateID := gjson.Get(batch[len(batch)-1], "update_id").Int()
+		for len(batch) != 0 {
+			failed, lastErr := d.deliverBatch(ctx, consumer, batch)
+			if ctx.Err() != nil {
+				return
+			}
+			if len(failed) == 0 {
+				retryInterval = time.Second
+				break
+			}
+			log.Printf("Failed to deliver %d updates to client %q: %v\n", len(failed), name, lastErr)
+			err = d.db.SetConsumerWebhookError(ctx, name, time.Now().Unix(), lastErr.Error())
+			if err != nil {
+				debug.PrintStack()
+				log.Println("Error:", err)
+			}
+			if !sleepContext(ctx, retryInterval) {
+				return
+			}
+			retryInterval = min(retryInterval*2, webhookMaxRetryInterval)
+			batch = failed
+		}
+
+		err = d.db.ConfirmUpdates(ctx, name, lastUpdateID+1)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			debug.PrintStack()
+			log.Println("Error:", err)
+		}
+	}
+}
+
+// deliverBatch posts the updates of each chat one after another, and those of different chats concurrently.
+// If an update fails, the later updates of the same chat are not sent, so they are returned in order together with the failed one.
+func (d *WebhookDispatcher) deliverBatch(ctx context.Context, consumer *Consumer, batch []string) (failed []string, lastErr error) {
+	var chats []string
+	lanes := make(map[string][]int)
+	for i, updateJSON := range batch {
+		chat := webhookChatKey(updateJSON)
+		if _, ok := lanes[chat]; !ok {
+			chats = append(chats, chat)
+		}
+		lanes[chat] = append(lanes[chat], i)
+	}
+	errs := make([]error, len(batch))
+	sent := make([]bool, len(batch))
+	var wg sync.WaitGroup
+	for _, chat := range chats {
+		wg.Add(1)
+		go func() {
+			for _, i := range lanes[chat] {
+				errs[i] = d.deliver(ctx, consumer, batch[i])
+				if errs[i] != nil {
+					break
+				}
+				sent[i] = true
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if !sent[i] {
+			failed = append(failed, batch[i])
+		}
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return failed, lastErr
+}
+
+// webhookChatKey returns the chat an update belongs to, or the user for updates outside of chats, such as inline queries.
+// Updates with neither of them share the same key.
+func webhookChatKey(updateJSON string) string {
+	var key string
+	gjson.Parse(updateJSON).ForEach(func(updateType, value gjson.Result) bool {
+		if updateType.String() == "update_id" || updateType.String() == "tbmux_origin" {
+			return true
+		}
+		for _, path := range []string{"chat.id", "message.chat.id", "from.id", "user.id"} {
+			if id := value.Get(path); id.Exists() {
+				key = id.Raw
+				return false
+			}
+		}
+		return false
+	})
+	return key
+}
+
+func (d *WebhookDispatcher) deliver(ctx context.Context, consumer *Consumer, updateJSON string) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	req, err := http.NewRequestWithContext(ctx, "POST", consumer.WebhookURL, bytes.NewBufferString(updateJSON))
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to send HTTP request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", httpUserAgent)
+	if len(consumer.WebhookSecretToken) != 0 {
+		req.Header.Set("X-Telegram-Bot-Api-Secret-Token", consumer.WebhookSecretToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("connection error: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, httpBodyLimit))
+	resp.Body.Close()
+	cancel()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("wrong response from the webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// sleepContext returns false if ctx is canceled before the duration elapses.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		timer.Stop()
+		return false
+	}
+}